@@ -0,0 +1,269 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// addrKind is the kind of a single address
+type addrKind int
+
+const (
+	addrLine     addrKind = iota // N
+	addrLast                     // $
+	addrRegex                    // /re/ or \cREc
+	addrStep                     // first~step
+	addrZero                     // 0, only as the start of 0,/re/
+	addrRelative                 // +N, only as the end of a range
+	addrMultiple                 // ~N, only as the end of a range
+)
+
+// addr is a single address
+type addr struct {
+	kind addrKind
+	n    int
+	step int
+	re   *regexp.Regexp
+}
+
+// Address selects lines like the addresses of sed commands do. It supports line numbers, `$` for the last line,
+// regular expressions (`/re/`, `\cREc`, optionally followed by `I` and `M`), steps (`first~step`), ranges of two addresses
+// (`addr1,addr2`), ranges relative to their start (`addr1,+N` and `addr1,~N`), `0,/re/` and negation with a trailing `!`.
+// Regular expressions use the syntax of the regexp package, except in a Script. An Address keeps the state of open ranges, so it has to
+// see every line exactly once and in order.
+type Address struct {
+	from, to *addr // to is nil for a single address
+	negate   bool
+	active   bool // a range is open
+	end      int  // line the open range of an addr1,+N address ends at
+}
+
+// ParseAddress parses a sed-style address, see Address
+func ParseAddress(s string) (*Address, error) {
+	address, rest, err := parseAddress(strings.TrimSpace(s), &regexScope{syntax: syntaxGo})
+	switch {
+	case err != nil:
+		return nil, err
+	case address == nil:
+		return nil, fmt.Errorf("empty address")
+	case rest != "":
+		return nil, fmt.Errorf("unexpected %q after address", rest)
+	}
+	return address, nil
+}
+
+// parseAddress parses the address at the start of s and returns the rest of s. It returns a nil address if s
+// does not start with one. Its regular expressions are compiled in scope.
+func parseAddress(s string, scope *regexScope) (*Address, string, error) {
+	from, s, err := parseAddr(s, false, scope)
+	switch {
+	case err != nil:
+		return nil, s, err
+	case from == nil:
+		return nil, s, nil
+	}
+	address := &Address{from: from}
+	switch {
+	case strings.HasPrefix(s, ","):
+		address.to, s, err = parseAddr(strings.TrimLeft(s[1:], " \t"), true, scope)
+		switch {
+		case err != nil:
+			return nil, s, err
+		case address.to == nil:
+			return nil, s, fmt.Errorf("missing end of address range")
+		}
+	}
+	switch {
+	case from.kind == addrZero && (address.to == nil || address.to.kind != addrRegex):
+		return nil, s, fmt.Errorf("invalid use of line address 0")
+	}
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case strings.HasPrefix(s, "!"):
+		address.negate = true
+		s = strings.TrimLeft(s[1:], " \t")
+	}
+	return address, s, nil
+}
+
+// parseAddr parses a single address at the start of s. end allows the forms that can only end a range.
+func parseAddr(s string, end bool, scope *regexScope) (*addr, string, error) {
+	switch {
+	case s == "":
+		return nil, s, nil
+	case s[0] == '$':
+		return &addr{kind: addrLast}, s[1:], nil
+	case s[0] == '/':
+		return parseRegexAddr(s[1:], '/', scope)
+	case s[0] == '\\' && len(s) > 1:
+		return parseRegexAddr(s[2:], s[1], scope)
+	case end && (s[0] == '+' || s[0] == '~'):
+		n, rest := leadingNumber(s[1:])
+		switch {
+		case n < 0:
+			return nil, s, fmt.Errorf("expected a number after %q", s[0])
+		case s[0] == '+':
+			return &addr{kind: addrRelative, n: n}, rest, nil
+		default:
+			return &addr{kind: addrMultiple, n: n}, rest, nil
+		}
+	}
+	n, rest := leadingNumber(s)
+	switch {
+	case n < 0:
+		return nil, s, nil
+	case strings.HasPrefix(rest, "~") && !end:
+		step, after := leadingNumber(rest[1:])
+		switch {
+		case step < 0:
+			return nil, s, fmt.Errorf("expected a step after %q", s[:len(s)-len(rest)+1])
+		}
+		return &addr{kind: addrStep, n: n, step: step}, after, nil
+	case n == 0 && !end:
+		return &addr{kind: addrZero}, rest, nil
+	case n == 0:
+		return nil, s, fmt.Errorf("invalid use of line address 0")
+	}
+	return &addr{kind: addrLine, n: n}, rest, nil
+}
+
+// leadingNumber parses the decimal number at the start of s, it returns -1 if there is none
+func leadingNumber(s string) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	switch i {
+	case 0:
+		return -1, s
+	}
+	n, err := strconv.Atoi(s[:i])
+	switch err {
+	case nil:
+		return n, s[i:]
+	default:
+		return -1, s
+	}
+}
+
+// parseRegexAddr parses a regular expression terminated by delim, followed by optional flags. An empty regular
+// expression stands for the last one in scope.
+func parseRegexAddr(s string, delim byte, scope *regexScope) (*addr, string, error) {
+	pattern, rest, err := splitDelimited(s, delim, scope.unescapeDelimiter(delim))
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, s, err
+	}
+	var flags string
+	for len(rest) > 0 && (rest[0] == 'I' || rest[0] == 'M') {
+		flags += strings.ToLower(rest[:1])
+		rest = rest[1:]
+	}
+	re, err := scope.compile(pattern, flags)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, s, err
+	}
+	return &addr{kind: addrRegex, re: re}, rest, nil
+}
+
+// splitDelimited returns the part of s up to the first delim that is not escaped with a backslash, and the rest
+// after that delim. Escaped delimiters are replaced with unescaped, every other escape is kept as it is.
+func splitDelimited(s string, delim byte, unescaped string) (string, string, error) {
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part.WriteString(unescaped)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			part.WriteString(s[i : i+2])
+			i++
+		case s[i] == delim:
+			return part.String(), s[i+1:], nil
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return "", s, fmt.Errorf("unterminated address regex")
+}
+
+// match reports whether a single address selects the line
+func (a *addr) match(line []byte, number int, last bool) bool {
+	switch a.kind {
+	case addrLine:
+		return number == a.n
+	case addrLast:
+		return last
+	case addrRegex:
+		return a.re.Match(line)
+	case addrStep:
+		switch {
+		case a.step <= 0:
+			return number == a.n
+		}
+		return number >= a.n && (number-a.n)%a.step == 0
+	default:
+		return false
+	}
+}
+
+// match reports whether the address selects the line, which is the number-th line of the input (counting from 1)
+// and does not include its line terminator. last is set for the last line of the input.
+func (a *Address) match(line []byte, number int, last bool) bool {
+	return a.matchRange(line, number, last) != a.negate
+}
+
+// closed reports whether no range is open after the last line that was matched. A nil Address has no ranges.
+func (a *Address) closed() bool {
+	return a == nil || a.negate || !a.active
+}
+
+// matchRange is match without negation
+func (a *Address) matchRange(line []byte, number int, last bool) bool {
+	switch {
+	case a.to == nil:
+		return a.from.match(line, number, last)
+	case a.active || (a.from.kind == addrZero && number == 1):
+		// The range is open, this line belongs to it and may close it
+		a.active = true
+		switch a.to.kind {
+		case addrLine:
+			a.active = number < a.to.n
+		case addrRelative:
+			a.active = number < a.end
+		case addrMultiple:
+			a.active = a.to.n > 0 && number%a.to.n != 0
+		case addrLast:
+			a.active = !last
+		case addrRegex:
+			a.active = !a.to.re.Match(line)
+		}
+		return true
+	case a.from.match(line, number, last):
+		// The start of a range, the end address is checked on this line unless it is a regular expression
+		a.active = true
+		switch a.to.kind {
+		case addrLine:
+			a.active = number < a.to.n
+		case addrRelative:
+			a.end = number + a.to.n
+			a.active = number < a.end
+		case addrMultiple:
+			a.active = a.to.n > 0 && number%a.to.n != 0
+		case addrLast:
+			a.active = !last
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"io"
+)
+
+// ahoCorasick is an Aho-Corasick automaton that reports the longest key ending at every input position
+type ahoCorasick struct {
+	root    [256]int32 // dense transitions out of the root, which is where most of the scanning happens
+	nodes   []ahoNode
+	lengths []int // lengths[key] = len(keys[key])
+	maxLen  int
+}
+
+// ahoNode is a single trie node of the automaton
+type ahoNode struct {
+	children map[byte]int32
+	fail     int32
+	match    int32 // index of the longest key that is a suffix of this node, -1 if there is none
+}
+
+// newAhoCorasick builds the automaton for the given keys. When a key appears more than once the first one wins.
+func newAhoCorasick(keys [][]byte) *ahoCorasick {
+	ac := &ahoCorasick{
+		nodes:   []ahoNode{{children: make(map[byte]int32), match: -1}},
+		lengths: make([]int, len(keys)),
+	}
+	for index, key := range keys {
+		state := int32(0)
+		for _, c := range key {
+			next, ok := ac.nodes[state].children[c]
+			switch ok {
+			case false:
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, ahoNode{children: make(map[byte]int32), match: -1})
+				ac.nodes[state].children[c] = next
+			}
+			state = next
+		}
+		switch ac.nodes[state].match {
+		case -1:
+			ac.nodes[state].match = int32(index)
+		}
+		ac.lengths[index] = len(key)
+		ac.maxLen = max(ac.maxLen, len(key))
+	}
+	// Breadth-first walk so that every fail target is complete before it is used
+	queue := make([]int32, 0, len(ac.nodes))
+	for c, child := range ac.nodes[0].children {
+		ac.root[c] = child
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.nodes[state].children {
+			ac.nodes[child].fail = ac.step(ac.nodes[state].fail, c)
+			switch ac.nodes[child].match {
+			case -1:
+				ac.nodes[child].match = ac.nodes[ac.nodes[child].fail].match
+			}
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// step returns the state reached from `state` when consuming `c`
+func (ac *ahoCorasick) step(state int32, c byte) int32 {
+	for state != 0 {
+		switch next, ok := ac.nodes[state].children[c]; ok {
+		case true:
+			return next
+		}
+		state = ac.nodes[state].fail
+	}
+	return ac.root[c]
+}
+
+// leftmostLongest returns the start and key index of the leftmost-longest match in s[from:], or -1 if there is none.
+// The match is only reported as determined once enough input follows it to rule out a longer or earlier match,
+// unless `final` is set, which means that no more input will follow s.
+func (ac *ahoCorasick) leftmostLongest(s []byte, from int, final bool) (int, int, bool) {
+	best, bestKey := -1, -1
+	state := int32(0)
+	for i := from; i < len(s); i++ {
+		switch {
+		case best >= 0 && i >= best+ac.maxLen:
+			// Every match starting at or before `best` has ended by now
+			return best, bestKey, true
+		}
+		state = ac.step(state, s[i])
+		key := ac.nodes[state].match
+		switch {
+		case key < 0:
+			continue
+		}
+		start := i - ac.lengths[key] + 1
+		switch {
+		case best < 0 || start < best || (start == best && ac.lengths[key] > ac.lengths[bestKey]):
+			best, bestKey = start, int(key)
+		}
+	}
+	return best, bestKey, best >= 0 && (final || len(s) >= best+ac.maxLen)
+}
+
+// MultiBytesReplacingReader allows transparent replacement of many tokens at once during read operation.
+// All tokens are matched in a single pass with leftmost-longest semantics, so replaced bytes are never
+// matched again by another token. This makes swapping `a` and `b` behave like `strings.NewReplacer`.
+type MultiBytesReplacingReader struct {
+	r       io.Reader
+	ac      *ahoCorasick
+	replace [][]byte
+	err     error
+	in      []byte // bytes read in but not yet processed
+	out     *bytes.Buffer
+	matches []int // matches[i] is the number of times search[i] has been replaced so far
+}
+
+// NewMultiBytesReplacingReader creates a new `*MultiBytesReplacingReader`.
+// `search[i]` is replaced with `replace[i]`. No token in `search` can be nil/empty, tokens in `replace` can.
+func NewMultiBytesReplacingReader(r io.Reader, search, replace [][]byte) *MultiBytesReplacingReader {
+	switch {
+	case r == nil:
+		panic("io.Reader cannot be nil")
+	case len(search) != len(replace):
+		panic("search and replace tokens must be the same length")
+	}
+	for _, token := range search {
+		switch len(token) {
+		case 0:
+			panic("search token cannot be nil/empty")
+		}
+	}
+	ac := newAhoCorasick(search)
+	return &MultiBytesReplacingReader{
+		r:       r,
+		ac:      ac,
+		replace: replace,
+		matches: make([]int, len(search)),
+		in:      make([]byte, 0, defaultBufSize+ac.maxLen),
+		out:     bytes.NewBuffer(make([]byte, 0, defaultBufSize+ac.maxLen)),
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *MultiBytesReplacingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		switch {
+		case r.err != nil && len(r.in) == 0:
+			return 0, r.err
+		}
+		for len(r.in) < cap(r.in) && r.err == nil {
+			n, err := r.r.Read(r.in[len(r.in):cap(r.in)])
+			r.in = r.in[:len(r.in)+n]
+			r.err = err
+		}
+		r.process()
+	}
+	return r.out.Read(p)
+}
+
+// process replaces every determined match into r.out and drops the consumed input.
+func (r *MultiBytesReplacingReader) process() {
+	final := r.err != nil
+	var last int
+	for {
+		start, key, ok := r.ac.leftmostLongest(r.in, last, final)
+		switch {
+		case start >= 0 && ok:
+			r.out.Write(r.in[last:start])
+			r.out.Write(r.replace[key])
+			r.matches[key]++
+			last = start + r.ac.lengths[key]
+			continue
+		}
+		break
+	}
+	cut := len(r.in)
+	switch final {
+	case false:
+		// Anything before this point can no longer be the start of a match
+		cut = max(last, len(r.in)-r.ac.maxLen+1)
+	}
+	r.out.Write(r.in[last:cut])
+	r.in = r.in[:copy(r.in, r.in[cut:])]
+}
+
+// Matches returns the number of times every search token has been replaced so far, in the order they were given.
+func (r *MultiBytesReplacingReader) Matches() []int {
+	return r.matches
+}
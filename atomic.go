@@ -0,0 +1,134 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// createTemp creates a temporary file in the same directory as path, so that it can later be
+// renamed over path atomically without ever crossing a filesystem boundary.
+func createTemp(path string, perm os.FileMode) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-gosed-*")
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	switch err := tmp.Chmod(perm); err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// discardTemp closes and removes a temporary file created by createTemp
+func discardTemp(tmp *os.File) {
+	_ = tmp.Close()
+	_ = os.Remove(tmp.Name())
+}
+
+// commitTemp flushes tmp to disk and atomically renames it over path, followed by an fsync of the
+// parent directory so the rename itself survives a crash. At any point in time path refers to either
+// the complete original or the complete new content, and tmp is removed if the commit fails.
+func commitTemp(tmp *os.File, path string) error {
+	switch err := flushTemp(tmp); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := os.Rename(tmp.Name(), path); err {
+	case nil:
+		break
+	default:
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// flushTemp flushes tmp to disk and closes it, tmp is removed if that fails
+func flushTemp(tmp *os.File) error {
+	switch err := tmp.Sync(); err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	switch err := tmp.Close(); err {
+	case nil:
+		break
+	default:
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// commit copies the original file's metadata to tmp unless disabled, makes sure the original has not been modified
+// if Config.DetectChanges is set, keeps a backup of the original if configured, then atomically renames tmp over the
+// original. While a Transaction stages the Replacer, tmp is handed to it instead.
+func (rp *Replacer) commit(tmp *os.File, report *ReplaceReport) error {
+	switch rp.Config.PreserveMetadata {
+	case true:
+		switch err := preserveMetadata(tmp, rp.Config.FilePath); err {
+		case nil:
+			break
+		default:
+			discardTemp(tmp)
+			return err
+		}
+	}
+	switch err := rp.unchanged(); err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	switch rp.Config.transaction {
+	case nil:
+		break
+	default:
+		return rp.Config.transaction.stage(rp, tmp, report)
+	}
+	backup, err := rp.backup(true)
+	switch err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	report.BackupPath = backup
+	return commitTemp(tmp, rp.Config.FilePath)
+}
+
+// syncDir fsyncs a directory so that entries created or renamed in it are durable
+func syncDir(dir string) error {
+	switch runtime.GOOS {
+	case "windows":
+		// Directories cannot be opened for syncing on windows, renames are durable once they return
+		return nil
+	}
+	d, err := os.Open(dir)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	defer func(d *os.File) {
+		_ = d.Close()
+	}(d)
+	return d.Sync()
+}
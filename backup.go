@@ -0,0 +1,172 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backup keeps the original of a file when it is replaced, like `sed -i.bak` does. The backup is a hard link to
+// the original, which costs no copying because the rewritten file replaces it under a new inode. Files rewritten
+// in place, and backups that cannot be linked (like those in a Dir on another filesystem), are copied instead.
+type Backup struct {
+	// Suffix is appended to the name of the backup
+	Suffix string
+	// Dir keeps the backups in this directory instead of next to the file, it is created if it does not exist
+	Dir string
+	// Keep enables numbered backups: the newest one is named <file><Suffix>.1 and the older ones are shifted up
+	// to <file><Suffix>.<Keep>, beyond which they are removed. Without Keep there is a single, overwritten backup.
+	Keep int
+}
+
+// path returns the name of the newest backup of file
+func (b *Backup) path(file string) string {
+	dir := filepath.Dir(file)
+	switch b.Dir {
+	case "":
+		break
+	default:
+		dir = b.Dir
+	}
+	name := filepath.Join(dir, filepath.Base(file)+b.Suffix)
+	switch b.Keep {
+	case 0:
+		return name
+	}
+	return name + ".1"
+}
+
+// valid returns an error if the backup of file would be file itself
+func (b *Backup) valid(file string) error {
+	switch {
+	case b.Keep < 0:
+		return fmt.Errorf("the number of backups to keep cannot be negative")
+	case b.Keep == 0 && samePath(b.path(file), file):
+		return fmt.Errorf("a backup needs a Suffix, a different Dir or Keep to not overwrite the file itself")
+	}
+	return nil
+}
+
+// make keeps original, the original content of file, as the newest backup of file. It is hard linked if link is set
+// and copied otherwise. It returns the path of the backup.
+func (b *Backup) make(file, original string, link bool) (string, error) {
+	switch err := b.valid(file); err {
+	case nil:
+		break
+	default:
+		return "", err
+	}
+	switch b.Dir {
+	case "":
+		break
+	default:
+		switch err := os.MkdirAll(b.Dir, 0755); err {
+		case nil:
+			break
+		default:
+			return "", err
+		}
+	}
+	switch err := b.rotate(file); err {
+	case nil:
+		break
+	default:
+		return "", err
+	}
+	path := b.path(file)
+	switch err := os.Remove(path); {
+	case err != nil && !os.IsNotExist(err):
+		return "", err
+	}
+	switch link {
+	case true:
+		switch err := os.Link(original, path); err {
+		case nil:
+			return path, syncDir(filepath.Dir(path))
+		}
+	}
+	return path, copyBackup(original, path)
+}
+
+// rotate shifts the numbered backups of file up by one, removing the oldest one
+func (b *Backup) rotate(file string) error {
+	switch b.Keep {
+	case 0:
+		return nil
+	}
+	base := b.path(file)
+	base = base[:len(base)-len(".1")]
+	switch err := os.Remove(fmt.Sprintf("%s.%d", base, b.Keep)); {
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	for n := b.Keep - 1; n >= 1; n-- {
+		switch err := os.Rename(fmt.Sprintf("%s.%d", base, n), fmt.Sprintf("%s.%d", base, n+1)); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBackup copies file and its metadata to path, through a temporary file so that path is never incomplete
+func copyBackup(file, path string) error {
+	in, err := os.Open(file)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+	info, err := in.Stat()
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	tmp, err := createTemp(path, info.Mode().Perm())
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	switch err {
+	case nil:
+		err = preserveMetadata(tmp, file)
+	}
+	switch err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	return commitTemp(tmp, path)
+}
+
+// samePath reports whether both paths refer to the same location, without following links
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// backup keeps the original file according to Config.Backup before it is replaced, and returns the path of the
+// backup or "" if there is none
+func (rp *Replacer) backup(link bool) (string, error) {
+	switch rp.Config.Backup {
+	case nil:
+		return "", nil
+	}
+	return rp.Config.Backup.make(rp.Config.FilePath, rp.Config.FilePath, link)
+}
@@ -0,0 +1,569 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+)
+
+const (
+	// bzip2BlockMagic starts every block of a bzip2 stream, and bzip2EndMagic the trailer at its end
+	bzip2BlockMagic = 0x314159265359
+	bzip2EndMagic   = 0x177245385090
+	// bzip2GroupSize is the number of symbols coded with the same Huffman table
+	bzip2GroupSize = 50
+	// bzip2MaxCodeLen is the longest Huffman code the writer uses, readers accept up to 20 bits
+	bzip2MaxCodeLen = 17
+)
+
+// bzip2CRCTable is the table of the big-endian CRC-32 used by bzip2, which is not the one of hash/crc32
+var bzip2CRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			switch crc & 0x80000000 {
+			case 0:
+				crc <<= 1
+			default:
+				crc = crc<<1 ^ 0x04c11db7
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// bzip2Writer compresses to the bzip2 format, which the standard library can only read. It holds a single block
+// of at most level * 100k bytes in memory, and codes it like the reference implementation does: run-length
+// encoding, the Burrows-Wheeler transform, move-to-front coding and up to six Huffman tables.
+type bzip2Writer struct {
+	bits     bitWriter
+	level    int
+	block    []byte // the run-length encoded input of the current block
+	crc      uint32 // of the input of the current block
+	combined uint32 // of the blocks written so far
+	run      byte   // the byte repeated by the pending run
+	runLen   int
+	header   bool // the stream header was written
+	closed   bool
+}
+
+// newBzip2Writer returns a writer that compresses to w with blocks of level * 100k bytes, level is 1 to 9
+func newBzip2Writer(w io.Writer, level int) (*bzip2Writer, error) {
+	switch {
+	case level < 1 || level > 9:
+		return nil, fmt.Errorf("invalid bzip2 level %d", level)
+	}
+	return &bzip2Writer{
+		bits:  bitWriter{w: w},
+		level: level,
+		block: make([]byte, 0, level*100000),
+		crc:   0xffffffff,
+	}, nil
+}
+
+// Write implements the `io.Writer` interface.
+func (zw *bzip2Writer) Write(p []byte) (int, error) {
+	switch {
+	case zw.closed:
+		return 0, fmt.Errorf("write to a closed bzip2 writer")
+	}
+	for _, b := range p {
+		switch {
+		case zw.runLen > 0 && (b != zw.run || zw.runLen == 255):
+			switch err := zw.flushRun(); err {
+			case nil:
+				break
+			default:
+				return 0, err
+			}
+		}
+		zw.run = b
+		zw.runLen++
+	}
+	return len(p), zw.bits.err
+}
+
+// Close writes the last block and the end of the stream, without closing the underlying writer
+func (zw *bzip2Writer) Close() error {
+	switch {
+	case zw.closed:
+		return nil
+	}
+	zw.closed = true
+	switch err := zw.flushRun(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch len(zw.block) {
+	case 0:
+		zw.writeHeader()
+	default:
+		zw.writeBlock()
+	}
+	zw.bits.write(48, bzip2EndMagic)
+	zw.bits.write(32, uint64(zw.combined))
+	return zw.bits.flush()
+}
+
+// flushRun adds the pending run to the block, the first four bytes of a run as they are and the rest as a count.
+// The block is written first if the run does not fit into it.
+func (zw *bzip2Writer) flushRun() error {
+	switch {
+	case zw.runLen == 0:
+		return nil
+	case len(zw.block)+5 > zw.level*100000-19:
+		zw.writeBlock()
+	}
+	for i := 0; i < zw.runLen; i++ {
+		zw.crc = zw.crc<<8 ^ bzip2CRCTable[byte(zw.crc>>24)^zw.run]
+	}
+	for i := 0; i < zw.runLen && i < 4; i++ {
+		zw.block = append(zw.block, zw.run)
+	}
+	switch {
+	case zw.runLen >= 4:
+		zw.block = append(zw.block, byte(zw.runLen-4))
+	}
+	zw.runLen = 0
+	return zw.bits.err
+}
+
+// writeHeader writes the stream header before the first block
+func (zw *bzip2Writer) writeHeader() {
+	switch zw.header {
+	case true:
+		return
+	}
+	zw.header = true
+	zw.bits.write(24, uint64('B')<<16|uint64('Z')<<8|uint64('h'))
+	zw.bits.write(8, uint64('0'+zw.level))
+}
+
+// writeBlock compresses and writes the current block, and starts the next one
+func (zw *bzip2Writer) writeBlock() {
+	zw.writeHeader()
+	crc := ^zw.crc
+	zw.combined = (zw.combined<<1 | zw.combined>>31) ^ crc
+	n := len(zw.block)
+	// The Burrows-Wheeler transform is the last column of the sorted rotations of the block
+	rotations := sortRotations(zw.block)
+	bwt := make([]byte, n)
+	var origin int
+	for i, start := range rotations {
+		switch start {
+		case 0:
+			origin = i
+			bwt[i] = zw.block[n-1]
+		default:
+			bwt[i] = zw.block[start-1]
+		}
+	}
+	var inUse [256]bool
+	for _, b := range bwt {
+		inUse[b] = true
+	}
+	symbols, freqs := bzip2MoveToFront(bwt, &inUse)
+	alphaSize := len(freqs)
+
+	zw.bits.write(48, bzip2BlockMagic)
+	zw.bits.write(32, uint64(crc))
+	// The block is not randomised
+	zw.bits.write(1, 0)
+	zw.bits.write(24, uint64(origin))
+	// The bytes in use, as a bitmap of ranges of 16 followed by a bitmap of every range in use
+	var ranges uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			switch inUse[i*16+j] {
+			case true:
+				ranges |= 1 << uint(15-i)
+			}
+		}
+	}
+	zw.bits.write(16, ranges)
+	for i := 0; i < 16; i++ {
+		switch ranges & (1 << uint(15-i)) {
+		case 0:
+			continue
+		}
+		var used uint64
+		for j := 0; j < 16; j++ {
+			switch inUse[i*16+j] {
+			case true:
+				used |= 1 << uint(15-j)
+			}
+		}
+		zw.bits.write(16, used)
+	}
+
+	tables, selectors := bzip2Tables(symbols, alphaSize)
+	zw.bits.write(3, uint64(len(tables)))
+	zw.bits.write(15, uint64(len(selectors)))
+	// The selectors are move-to-front coded in unary
+	order := make([]byte, len(tables))
+	for i := range order {
+		order[i] = byte(i)
+	}
+	for _, selector := range selectors {
+		j := 0
+		for order[j] != selector {
+			j++
+		}
+		copy(order[1:j+1], order[:j])
+		order[0] = selector
+		for ; j > 0; j-- {
+			zw.bits.write(1, 1)
+		}
+		zw.bits.write(1, 0)
+	}
+	// The code lengths of every table are delta coded
+	codes := make([][]uint32, len(tables))
+	for t, lengths := range tables {
+		current := lengths[0]
+		zw.bits.write(5, uint64(current))
+		for _, length := range lengths {
+			for ; current < length; current++ {
+				zw.bits.write(2, 2)
+			}
+			for ; current > length; current-- {
+				zw.bits.write(2, 3)
+			}
+			zw.bits.write(1, 0)
+		}
+		codes[t] = canonicalCodes(lengths)
+	}
+	for i, symbol := range symbols {
+		t := selectors[i/bzip2GroupSize]
+		zw.bits.write(uint(tables[t][symbol]), uint64(codes[t][symbol]))
+	}
+
+	zw.block = zw.block[:0]
+	zw.crc = 0xffffffff
+}
+
+// bzip2MoveToFront codes the transformed block with move-to-front over the bytes in use, and zero runs in the
+// bijective base 2 of RUNA (0) and RUNB (1). It returns the symbols, ending with the end of block symbol, and the
+// frequency of every symbol of the alphabet.
+func bzip2MoveToFront(bwt []byte, inUse *[256]bool) ([]uint16, []int) {
+	order := make([]byte, 0, 256)
+	for b, used := range inUse {
+		switch used {
+		case true:
+			order = append(order, byte(b))
+		}
+	}
+	alphaSize := len(order) + 2
+	freqs := make([]int, alphaSize)
+	symbols := make([]uint16, 0, len(bwt)+1)
+	emit := func(symbol uint16) {
+		symbols = append(symbols, symbol)
+		freqs[symbol]++
+	}
+	zeros := 0
+	flushZeros := func() {
+		for zeros > 0 {
+			zeros--
+			emit(uint16(zeros & 1))
+			zeros >>= 1
+		}
+	}
+	for _, b := range bwt {
+		j := 0
+		for order[j] != b {
+			j++
+		}
+		switch j {
+		case 0:
+			zeros++
+			continue
+		}
+		flushZeros()
+		copy(order[1:j+1], order[:j])
+		order[0] = b
+		emit(uint16(j + 1))
+	}
+	flushZeros()
+	emit(uint16(alphaSize - 1))
+	return symbols, freqs
+}
+
+// bzip2Tables chooses the Huffman tables of a block and the table of every group of symbols, refining tables that
+// start out as ranges of the alphabet like the reference implementation does. It returns the code lengths of every
+// table and the selectors.
+func bzip2Tables(symbols []uint16, alphaSize int) ([][]uint8, []byte) {
+	var count int
+	switch n := len(symbols); {
+	case n < 200:
+		count = 2
+	case n < 600:
+		count = 3
+	case n < 1200:
+		count = 4
+	case n < 2400:
+		count = 5
+	default:
+		count = 6
+	}
+	freqs := make([]int, alphaSize)
+	for _, symbol := range symbols {
+		freqs[symbol]++
+	}
+	// Every table starts out cheap for a range of the alphabet holding an equal share of the symbols
+	tables := make([][]uint8, count)
+	remaining, start := len(symbols), 0
+	for t := range tables {
+		tables[t] = make([]uint8, alphaSize)
+		target, sum, end := remaining/(count-t), 0, start
+		for end < alphaSize && (sum < target || end == start) {
+			sum += freqs[end]
+			end++
+		}
+		for v := range tables[t] {
+			switch {
+			case v < start || v >= end:
+				tables[t][v] = 15
+			}
+		}
+		remaining -= sum
+		start = end
+	}
+	selectors := make([]byte, (len(symbols)+bzip2GroupSize-1)/bzip2GroupSize)
+	for iteration := 0; iteration < 4; iteration++ {
+		tableFreqs := make([][]int, count)
+		for t := range tableFreqs {
+			tableFreqs[t] = make([]int, alphaSize)
+		}
+		for g := range selectors {
+			group := symbols[g*bzip2GroupSize:]
+			switch {
+			case len(group) > bzip2GroupSize:
+				group = group[:bzip2GroupSize]
+			}
+			best, bestCost := 0, -1
+			for t, lengths := range tables {
+				cost := 0
+				for _, symbol := range group {
+					cost += int(lengths[symbol])
+				}
+				switch {
+				case bestCost < 0 || cost < bestCost:
+					best, bestCost = t, cost
+				}
+			}
+			selectors[g] = byte(best)
+			for _, symbol := range group {
+				tableFreqs[best][symbol]++
+			}
+		}
+		for t := range tables {
+			tables[t] = huffmanLengths(tableFreqs[t], bzip2MaxCodeLen)
+		}
+	}
+	return tables, selectors
+}
+
+// huffmanNode is a node of the tree built by huffmanLengths
+type huffmanNode struct {
+	weight int
+	index  int
+}
+
+// huffmanHeap is a min-heap of huffmanNodes
+type huffmanHeap []huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	return h[i].weight < h[j].weight || h[i].weight == h[j].weight && h[i].index < h[j].index
+}
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
+
+// huffmanLengths returns the Huffman code length of every symbol, which are at most maxLen long. Symbols that do
+// not occur get a code as well, as bzip2 codes the whole alphabet.
+func huffmanLengths(freqs []int, maxLen int) []uint8 {
+	n := len(freqs)
+	weights := make([]int, n)
+	for i, freq := range freqs {
+		weights[i] = freq + 1
+	}
+	lengths := make([]uint8, n)
+	parents := make([]int, 2*n)
+	for {
+		h := make(huffmanHeap, 0, n)
+		for i, weight := range weights {
+			h = append(h, huffmanNode{weight: weight, index: i})
+		}
+		heap.Init(&h)
+		next := n
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(huffmanNode)
+			b := heap.Pop(&h).(huffmanNode)
+			parents[a.index], parents[b.index] = next, next
+			heap.Push(&h, huffmanNode{weight: a.weight + b.weight, index: next})
+			next++
+		}
+		root := next - 1
+		longest := 0
+		for i := range lengths {
+			depth := 0
+			for j := i; j != root; j = parents[j] {
+				depth++
+			}
+			lengths[i] = uint8(depth)
+			switch {
+			case depth > longest:
+				longest = depth
+			}
+		}
+		switch {
+		case longest <= maxLen:
+			return lengths
+		}
+		// Flatten the weights until the tree is shallow enough
+		for i := range weights {
+			weights[i] = 1 + weights[i]/2
+		}
+	}
+}
+
+// canonicalCodes returns the canonical Huffman codes of the code lengths, in which shorter codes and then lower
+// symbols come first
+func canonicalCodes(lengths []uint8) []uint32 {
+	codes := make([]uint32, len(lengths))
+	var code uint32
+	for length := uint8(1); length <= 20; length++ {
+		for symbol, l := range lengths {
+			switch l {
+			case length:
+				codes[symbol] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// sortRotations returns the start of every rotation of s in sorted order, by doubling the length of the sorted
+// prefixes with counting sorts
+func sortRotations(s []byte) []int32 {
+	n := len(s)
+	sorted := make([]int32, n)
+	classes := make([]int32, n)
+	counts := make([]int32, 256)
+	switch {
+	case n > 256:
+		counts = make([]int32, n)
+	}
+	for _, b := range s {
+		counts[b]++
+	}
+	for i := 1; i < 256; i++ {
+		counts[i] += counts[i-1]
+	}
+	for i := n - 1; i >= 0; i-- {
+		counts[s[i]]--
+		sorted[counts[s[i]]] = int32(i)
+	}
+	count := int32(1)
+	for i := 1; i < n; i++ {
+		switch {
+		case s[sorted[i]] != s[sorted[i-1]]:
+			count++
+		}
+		classes[sorted[i]] = count - 1
+	}
+	bySecond := make([]int32, n)
+	next := make([]int32, n)
+	for k := 1; k < n && int(count) < n; k <<= 1 {
+		// Sorted by the second half already, the rotations starting k earlier only need a stable sort by the first
+		for i, start := range sorted {
+			bySecond[i] = start - int32(k)
+			switch {
+			case bySecond[i] < 0:
+				bySecond[i] += int32(n)
+			}
+		}
+		for i := int32(0); i < count; i++ {
+			counts[i] = 0
+		}
+		for _, start := range bySecond {
+			counts[classes[start]]++
+		}
+		for i := int32(1); i < count; i++ {
+			counts[i] += counts[i-1]
+		}
+		for i := n - 1; i >= 0; i-- {
+			class := classes[bySecond[i]]
+			counts[class]--
+			sorted[counts[class]] = bySecond[i]
+		}
+		next[sorted[0]] = 0
+		count = 1
+		for i := 1; i < n; i++ {
+			current, previous := sorted[i], sorted[i-1]
+			switch {
+			case classes[current] != classes[previous] || classes[(int(current)+k)%n] != classes[(int(previous)+k)%n]:
+				count++
+			}
+			next[current] = count - 1
+		}
+		classes, next = next, classes
+	}
+	return sorted
+}
+
+// bitWriter writes big-endian bit fields, as bzip2 does
+type bitWriter struct {
+	w     io.Writer
+	acc   uint64
+	nbits uint
+	buf   []byte
+	err   error
+}
+
+// write writes the lowest n bits of v, n is at most 48
+func (bw *bitWriter) write(n uint, v uint64) {
+	bw.acc = bw.acc<<n | v&(1<<n-1)
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.nbits -= 8
+		bw.buf = append(bw.buf, byte(bw.acc>>bw.nbits))
+	}
+	switch {
+	case len(bw.buf) >= 64*1024:
+		bw.drain()
+	}
+}
+
+// drain writes the complete bytes to the underlying writer
+func (bw *bitWriter) drain() {
+	switch {
+	case bw.err == nil && len(bw.buf) > 0:
+		_, bw.err = bw.w.Write(bw.buf)
+	}
+	bw.buf = bw.buf[:0]
+}
+
+// flush pads the last byte with zero bits and writes everything to the underlying writer
+func (bw *bitWriter) flush() error {
+	switch {
+	case bw.nbits > 0:
+		bw.write(8-bw.nbits, 0)
+	}
+	bw.drain()
+	return bw.err
+}
@@ -1,30 +1,503 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/carterpeel/gosed"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// Exit codes, which tell "nothing matched" apart from errors like grep's do
+const (
+	exitMatched = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+const usage = `Usage: %[1]s [flags] (-e <old>=<new> | --line <command> | --script <script> | -f <file>)... [<file>...]
+       %[1]s [flags] <file> <old> <new>
+
+Replaces old with new in every file, or in stdin if there is no file or the file is "-", and writes the result to
+stdout unless -i is given. Mappings, line commands and scripts are applied in the order they are given. The second
+form replaces old with new in the file itself.
+
+The exit status is 0 if anything was replaced, 1 if nothing was and 2 if an error occurred. If a script is given
+(with --script or -f), the status is 0 unless an error occurred, like sed's, and q and Q take no exit code.
+
+Flags:
+`
+
+// stage is a mapping, line command or piece of a script given on the command line
+type stage struct {
+	kind  string // the name of the flag
+	value string
+}
+
+// stageFlag collects the stages of a flag into the shared list, so that their order across flags is kept
+type stageFlag struct {
+	kind   string
+	stages *[]stage
+}
+
+// String implements the `flag.Value` interface.
+func (f *stageFlag) String() string {
+	return ""
+}
+
+// Set implements the `flag.Value` interface.
+func (f *stageFlag) Set(value string) error {
+	*f.stages = append(*f.stages, stage{kind: f.kind, value: value})
+	return nil
+}
+
+// inPlaceFlag is the -i flag, its optional backup suffix has to be attached like in `-i.bak`
+type inPlaceFlag struct {
+	enabled bool
+	suffix  string
+}
+
+// String implements the `flag.Value` interface.
+func (f *inPlaceFlag) String() string {
+	return ""
+}
+
+// Set implements the `flag.Value` interface.
+func (f *inPlaceFlag) Set(value string) error {
+	switch value {
+	case "false":
+		f.enabled, f.suffix = false, ""
+	case "true":
+		f.enabled, f.suffix = true, ""
+	default:
+		f.enabled, f.suffix = true, value
+	}
+	return nil
+}
+
+// IsBoolFlag lets -i be given without a value.
+func (f *inPlaceFlag) IsBoolFlag() bool {
+	return true
+}
+
+// lockFlag is the --lock flag, which names a gosed.LockMode
+type lockFlag struct {
+	mode gosed.LockMode
+}
+
+// String implements the `flag.Value` interface.
+func (f *lockFlag) String() string {
+	return f.mode.String()
+}
+
+// Set implements the `flag.Value` interface.
+func (f *lockFlag) Set(value string) error {
+	for _, mode := range []gosed.LockMode{gosed.LockNone, gosed.LockShared, gosed.LockExclusive} {
+		switch mode.String() {
+		case value:
+			f.mode = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown lock mode %q, expected none, shared or exclusive", value)
+}
+
+// compressionFlag is the --compression flag, which names a gosed.Compression
+type compressionFlag struct {
+	compression gosed.Compression
+}
+
+// String implements the `flag.Value` interface.
+func (f *compressionFlag) String() string {
+	return f.compression.String()
+}
+
+// Set implements the `flag.Value` interface.
+func (f *compressionFlag) Set(value string) error {
+	for _, compression := range []gosed.Compression{gosed.CompressionNone, gosed.CompressionAuto, gosed.CompressionGzip, gosed.CompressionZstd, gosed.CompressionBzip2, gosed.CompressionXz} {
+		switch compression.String() {
+		case value:
+			f.compression = compression
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression %q, expected none, auto, gzip, zstd, bzip2 or xz", value)
+}
+
+// options are the parsed flags
+type options struct {
+	stages       []stage
+	quiet        bool
+	extended     bool
+	inPlace      inPlaceFlag
+	dryRun       bool
+	chained      bool
+	sequential   bool
+	simultaneous bool
+	mmap         bool
+	backupDir    string
+	backups      int
+	lock         lockFlag
+	compression  compressionFlag
+	lockTimeout  time.Duration
+	verbose      bool
+}
+
 func main() {
-	// Creates a new replacer type with the provided file
-	replacer, err := NewReplacer(os.Args[1])
-	if err != nil {
-		log.Fatal(err.Error())
+	os.Exit(run(filepath.Base(os.Args[0]), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run parses the arguments, processes every file and returns the exit status. name is the name of the command in
+// the usage text and the error messages.
+func run(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := log.New(stderr, name+": ", 0)
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var opts options
+	stageVar := func(kind, alias, help string) {
+		flags.Var(&stageFlag{kind: kind, stages: &opts.stages}, kind, help)
+		switch len(kind) {
+		case 1:
+			flags.Var(&stageFlag{kind: kind, stages: &opts.stages}, alias, "alias for -"+kind)
+		default:
+			flags.Var(&stageFlag{kind: kind, stages: &opts.stages}, alias, "alias for --"+kind)
+		}
 	}
-	// Creates a new old:new string mapping
-	if err := replacer.NewStringMapping(os.Args[2], os.Args[3]); err != nil {
-		log.Fatal(err.Error())
+	stageVar("e", "expression", "a mapping `old=new`, a literal = in old is written as \\=, can be repeated")
+	stageVar("line", "l", "a sed line `command` like '/^\\[server\\]/a port=80', '$a text', '5,10d' or '/x/c text', can be repeated")
+	stageVar("script", "s", "a sed `script`, consecutive scripts and script files are joined like sed's -e and -f, can be repeated")
+	stageVar("f", "file", "a sed script `file`, can be repeated")
+	flags.BoolVar(&opts.quiet, "n", false, "only print what the scripts print, like sed -n")
+	flags.BoolVar(&opts.quiet, "quiet", false, "alias for -n")
+	flags.BoolVar(&opts.extended, "E", false, "use extended regular expressions in the scripts instead of basic ones, like sed -E")
+	flags.BoolVar(&opts.extended, "r", false, "alias for -E")
+	flags.BoolVar(&opts.extended, "regexp-extended", false, "alias for -E")
+	flags.Var(&opts.inPlace, "i", "replace in the files instead of writing to stdout, -iSUFFIX keeps the original as file+SUFFIX")
+	flags.Var(&opts.inPlace, "in-place", "alias for -i, the suffix is given as --in-place=SUFFIX")
+	flags.StringVar(&opts.backupDir, "backup-dir", "", "keep the originals replaced by -i in this `directory` instead of next to the files")
+	flags.IntVar(&opts.backups, "backups", 0, "keep `n` numbered backups of the originals replaced by -i, named file+SUFFIX.1 (the newest) to file+SUFFIX.n")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "print a unified diff of the changes instead of replacing the files or writing them to stdout")
+	flags.BoolVar(&opts.dryRun, "diff", false, "alias for --dry-run")
+	flags.BoolVar(&opts.sequential, "sequential", false, "apply the mappings one after another with a temporary file each (default)")
+	flags.BoolVar(&opts.chained, "chained", false, "apply the mappings one after another in a single pass")
+	flags.BoolVar(&opts.simultaneous, "simultaneous", false, "match all of the mappings at once, so replacements are never replaced again")
+	flags.Var(&opts.lock, "lock", "take a `mode` (shared or exclusive) advisory lock on every file replaced by -i while it is replaced")
+	flags.DurationVar(&opts.lockTimeout, "lock-timeout", 0, "give up on a file if its --lock cannot be taken within this `duration` (default: wait forever)")
+	flags.Var(&opts.compression, "compression", "replace within compressed files as if they were decompressed, `mode` is auto (detected by magic bytes), gzip, zstd, bzip2 or xz")
+	flags.BoolVar(&opts.mmap, "mmap", false, "memory-map the files instead of streaming them")
+	flags.BoolVar(&opts.verbose, "v", false, "report the matches of every file on stderr")
+	flags.BoolVar(&opts.verbose, "verbose", false, "alias for -v")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), usage, name)
+		flags.PrintDefaults()
+	}
+	switch err := flags.Parse(attachedSuffix(flags, args)); err {
+	case nil:
+		break
+	case flag.ErrHelp:
+		return exitMatched
+	default:
+		return exitError
 	}
 
-	// Replace() Executes a SEQUENTIAL replace operation, meaning a temporary file is allocated for each
-	// old:new mapping (slower, less CPU intensive)
+	files := flags.Args()
+	switch {
+	case len(opts.stages) == 0 && len(files) == 3:
+		// The original `<file> <old> <new>` form
+		opts.stages = []stage{{kind: "mapping", value: files[1]}, {kind: "replacement", value: files[2]}}
+		opts.inPlace.enabled = true
+		files = files[:1]
+	case len(opts.stages) == 0:
+		flags.Usage()
+		return exitError
+	case len(files) == 0:
+		files = []string{"-"}
+	}
+	var modes int
+	for _, mode := range []bool{opts.chained, opts.sequential, opts.simultaneous} {
+		switch mode {
+		case true:
+			modes++
+		}
+	}
+	switch {
+	case modes > 1:
+		logger.Print("only one of --chained, --sequential and --simultaneous can be given")
+		return exitError
+	case opts.compression.compression != gosed.CompressionNone && !opts.inPlace.enabled && !opts.dryRun:
+		logger.Print("--compression needs -i or --dry-run")
+		return exitError
+	}
+	configure, err := opts.build()
+	switch err {
+	case nil:
+		break
+	default:
+		logger.Print(err.Error())
+		return exitError
+	}
 
-	// Keep in mind this iterates through the mappings in order, so newly replaced byte sequences can
-	// potentially be replaced by the next old:new mapping, but only if they match.
-	start := time.Now()
-	if _, err := replacer.Replace(); err != nil {
-		log.Fatal(err.Error())
+	output := bufio.NewWriter(stdout)
+	defer func() {
+		_ = output.Flush()
+	}()
+	status := exitNoMatch
+	switch opts.scripted() {
+	case true:
+		status = exitMatched
+	}
+	for _, file := range files {
+		var report *gosed.ReplaceReport
+		switch {
+		case file == "-" && (opts.inPlace.enabled || opts.dryRun):
+			err = fmt.Errorf("stdin cannot be replaced in place or diffed")
+		case opts.inPlace.enabled || opts.dryRun:
+			report, err = opts.replace(file, configure)
+		default:
+			report, err = opts.copy(output, stdin, file, configure)
+		}
+		switch {
+		case err != nil:
+			logger.Printf("%s: %s", file, err.Error())
+			status = exitError
+			continue
+		case report.TotalMatches() > 0 && status == exitNoMatch:
+			status = exitMatched
+		}
+		switch opts.verbose {
+		case true:
+			logger.Printf("%s: %v matches, read %d bytes and wrote %d in %s", file, report.Matches, report.BytesRead, report.BytesWritten, report.Duration)
+		}
+	}
+	return status
+}
+
+// attachedSuffix rewrites `-iSUFFIX`, which the flag package cannot parse, to `-i=SUFFIX`
+func attachedSuffix(flags *flag.FlagSet, args []string) []string {
+	rewritten := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		switch known := flags.Lookup(name); {
+		case arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-"):
+			// The flags end here
+			return append(rewritten, args[i:]...)
+		case known == nil && strings.HasPrefix(arg, "-i") && !strings.HasPrefix(arg, "--"):
+			arg = "-i=" + arg[2:]
+		case known != nil && !strings.Contains(arg, "=") && !isBoolFlag(known) && i+1 < len(args):
+			// The next argument is the value of this flag
+			rewritten = append(rewritten, arg)
+			i++
+			arg = args[i]
+		}
+		rewritten = append(rewritten, arg)
+	}
+	return rewritten
+}
+
+// isBoolFlag reports whether the flag can be given without a value
+func isBoolFlag(f *flag.Flag) bool {
+	value, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && value.IsBoolFlag()
+}
+
+// scripted reports whether any of the stages is a script or a script file
+func (opts *options) scripted() bool {
+	for _, current := range opts.stages {
+		switch current.kind {
+		case "script", "f":
+			return true
+		}
+	}
+	return false
+}
+
+// build parses the stages into a function adding them to a Transformer. Consecutive scripts and script
+// files are joined into a single script, so that blocks and labels can span them like they do in sed.
+func (opts *options) build() (func(*gosed.Transformer) error, error) {
+	steps := make([]func(*gosed.Transformer) error, 0)
+	var script []string
+	endScript := func() error {
+		switch len(script) {
+		case 0:
+			return nil
+		}
+		parse := gosed.ParseScript
+		switch opts.extended {
+		case true:
+			parse = gosed.ParseExtendedScript
+		}
+		parsed, err := parse(strings.Join(script, "\n"))
+		switch err {
+		case nil:
+			break
+		default:
+			return err
+		}
+		parsed.Quiet = parsed.Quiet || opts.quiet
+		script = nil
+		steps = append(steps, func(t *gosed.Transformer) error {
+			return t.NewScript(parsed)
+		})
+		return nil
+	}
+	for index := 0; index < len(opts.stages); index++ {
+		current := opts.stages[index]
+		switch current.kind {
+		case "script":
+			script = append(script, current.value)
+			continue
+		case "f":
+			content, err := ioutil.ReadFile(current.value)
+			switch err {
+			case nil:
+				script = append(script, strings.TrimSuffix(string(content), "\n"))
+				continue
+			default:
+				return nil, err
+			}
+		}
+		switch err := endScript(); err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		switch current.kind {
+		case "e":
+			old, replacement, err := splitMapping(current.value)
+			switch err {
+			case nil:
+				break
+			default:
+				return nil, err
+			}
+			steps = append(steps, func(t *gosed.Transformer) error {
+				return t.NewStringMapping(old, replacement)
+			})
+		case "mapping":
+			// The original form, whose old and new are separate arguments
+			replacement := opts.stages[index+1].value
+			index++
+			steps = append(steps, func(t *gosed.Transformer) error {
+				return t.NewStringMapping(current.value, replacement)
+			})
+		case "line":
+			steps = append(steps, func(t *gosed.Transformer) error {
+				return t.NewLineCommandString(current.value)
+			})
+		}
+	}
+	switch err := endScript(); err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	// Check the stages once, instead of for every file
+	configure := func(t *gosed.Transformer) error {
+		t.Simultaneous = opts.simultaneous
+		for _, step := range steps {
+			switch err := step(t); err {
+			case nil:
+				break
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+	return configure, configure(gosed.NewTransformer())
+}
+
+// splitMapping splits an `old=new` mapping at the first = that is not escaped with a backslash
+func splitMapping(expr string) (string, string, error) {
+	var old strings.Builder
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr) && (expr[i+1] == '=' || expr[i+1] == '\\'):
+			old.WriteByte(expr[i+1])
+			i++
+		case expr[i] == '=':
+			return old.String(), expr[i+1:], nil
+		default:
+			old.WriteByte(expr[i])
+		}
+	}
+	return "", "", fmt.Errorf("mapping %q is missing the = between old and new", expr)
+}
+
+// copy writes the file (or stdin for "-") with the stages applied to w
+func (opts *options) copy(w io.Writer, stdin io.Reader, file string, configure func(*gosed.Transformer) error) (*gosed.ReplaceReport, error) {
+	input := stdin
+	switch file {
+	case "-":
+		break
+	default:
+		fi, err := os.Open(file)
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		defer func(fi *os.File) {
+			_ = fi.Close()
+		}(fi)
+		input = fi
+	}
+	transformer := gosed.NewTransformer()
+	switch err := configure(transformer); err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	return transformer.Copy(w, input)
+}
+
+// replace applies the stages to the file itself, or prints a diff of the changes for --dry-run
+func (opts *options) replace(file string, configure func(*gosed.Transformer) error) (*gosed.ReplaceReport, error) {
+	replacer, err := gosed.NewReplacer(file)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	defer func(replacer *gosed.Replacer) {
+		_ = replacer.Close()
+	}(replacer)
+	switch err := configure(replacer.Config.Transformer); err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	replacer.Config.DryRun = opts.dryRun
+	replacer.Config.Lock = opts.lock.mode
+	replacer.Config.Compression = opts.compression.compression
+	replacer.Config.LockTimeout = opts.lockTimeout
+	switch opts.mmap {
+	case true:
+		replacer.Config.Engine = gosed.EngineMmap
+	}
+	switch {
+	case opts.inPlace.suffix != "" || opts.backupDir != "" || opts.backups > 0:
+		replacer.Config.Backup = &gosed.Backup{Suffix: opts.inPlace.suffix, Dir: opts.backupDir, Keep: opts.backups}
+	}
+	switch {
+	case opts.chained:
+		return replacer.ReplaceChained()
+	case opts.simultaneous:
+		return replacer.ReplaceSimultaneous()
+	default:
+		return replacer.Replace()
 	}
-	log.Printf("Operation completed in %s", time.Since(start))
 }
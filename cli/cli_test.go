@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachedSuffix(t *testing.T) {
+	flags := flag.NewFlagSet("gosed", flag.ContinueOnError)
+	var inPlace inPlaceFlag
+	var expression, script stageFlag
+	flags.Var(&inPlace, "i", "")
+	flags.Var(&expression, "e", "")
+	flags.Var(&script, "s", "")
+	flags.Bool("n", false, "")
+	cases := map[string]string{
+		"-i.bak -e a=b file":   "-i=.bak -e a=b file",
+		"-i -e a=b file":       "-i -e a=b file",
+		"-i=.orig file":        "-i=.orig file",
+		"-e -i.bak file":       "-e -i.bak file",
+		"-n -s -i.x -- -i.bak": "-n -s -i.x -- -i.bak",
+		"-e a=b - -i.bak":      "-e a=b - -i.bak",
+		"-ibackup/ --in-place": "-i=backup/ --in-place",
+		"file -i.bak":          "file -i.bak",
+		"--i.bak -e a=b file":  "--i.bak -e a=b file",
+		"-s s/a/b/ -i~ file":   "-s s/a/b/ -i=~ file",
+	}
+	for args, expected := range cases {
+		got := strings.Join(attachedSuffix(flags, strings.Fields(args)), " ")
+		if got != expected {
+			t.Fatal(fmt.Errorf("%q: expected %q, got %q", args, expected, got))
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	cases := []struct {
+		name   string
+		args   []string
+		stdin  string
+		file   string // the content of file.txt before the run, if any
+		stdout string
+		status int
+		// files maps the paths to their expected content after the run
+		files map[string]string
+	}{
+		{name: "stdin", args: []string{"-e", "a=b"}, stdin: "aaa\n", stdout: "bbb\n", status: exitMatched},
+		{name: "stdin dash", args: []string{"-e", "a=b", "-"}, stdin: "xyz\n", stdout: "xyz\n", status: exitNoMatch},
+		{name: "file to stdout", args: []string{"-e", "a=b", path("file.txt")}, file: "abc\n", stdout: "bbc\n", status: exitMatched,
+			files: map[string]string{path("file.txt"): "abc\n"}},
+		{name: "in place with suffix", args: []string{"-i.bak", "-e", "a=b", path("file.txt")}, file: "abc\n", status: exitMatched,
+			files: map[string]string{path("file.txt"): "bbc\n", path("file.txt.bak"): "abc\n"}},
+		{name: "in place without suffix", args: []string{"-i", "-e", "x=y", path("file.txt")}, file: "abc\n", status: exitNoMatch,
+			files: map[string]string{path("file.txt"): "abc\n"}},
+		{name: "legacy form", args: []string{path("file.txt"), "abc", "xyz"}, file: "abc abc\n", status: exitMatched,
+			files: map[string]string{path("file.txt"): "xyz xyz\n"}},
+		{name: "script without substitutions", args: []string{"-n", "-s", "2p", path("file.txt")}, file: "one\ntwo\n", stdout: "two\n", status: exitMatched},
+		{name: "script quitting", args: []string{"-s", "s/x/y/;q"}, stdin: "one\ntwo\n", stdout: "one\n", status: exitMatched},
+		{name: "extended script", args: []string{"-E", "-s", `s/(o+)/[\1]/`}, stdin: "foo\n", stdout: "f[oo]\n", status: exitMatched},
+		{name: "basic script", args: []string{"-s", `s/\(o\+\)/[\1]/`}, stdin: "foo\n", stdout: "f[oo]\n", status: exitMatched},
+		{name: "missing file", args: []string{"-e", "a=b", path("missing.txt")}, status: exitError},
+		{name: "invalid script", args: []string{"-s", "k"}, stdin: "a\n", status: exitError},
+		{name: "unknown flag", args: []string{"--unknown", "-e", "a=b"}, stdin: "a\n", status: exitError},
+		{name: "no stages", args: []string{path("file.txt")}, file: "abc\n", status: exitError},
+		{name: "stdin in place", args: []string{"-i", "-e", "a=b", "-"}, stdin: "a\n", status: exitError},
+		{name: "help", args: []string{"-h"}, status: exitMatched},
+	}
+	for _, c := range cases {
+		for _, name := range []string{"file.txt", "file.txt.bak"} {
+			_ = os.Remove(path(name))
+		}
+		if c.file != "" {
+			if err := ioutil.WriteFile(path("file.txt"), []byte(c.file), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		var stdout, stderr bytes.Buffer
+		status := run("gosed", c.args, strings.NewReader(c.stdin), &stdout, &stderr)
+		if status != c.status {
+			t.Fatal(fmt.Errorf("%s: expected exit status %d, got %d (%s)", c.name, c.status, status, stderr.String()))
+		}
+		if stdout.String() != c.stdout {
+			t.Fatal(fmt.Errorf("%s: expected %q on stdout, got %q", c.name, c.stdout, stdout.String()))
+		}
+		if c.status == exitError && stderr.Len() == 0 {
+			t.Fatal(fmt.Errorf("%s: expected an error message on stderr", c.name))
+		}
+		for file, expected := range c.files {
+			got, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(fmt.Errorf("%s: %s", c.name, err.Error()))
+			}
+			if string(got) != expected {
+				t.Fatal(fmt.Errorf("%s: expected %q in %s, got %q", c.name, expected, file, got))
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LineCommand is a sed command that edits whole lines
+type LineCommand byte
+
+const (
+	// InsertLine writes the text before every selected line, like sed's `i`
+	InsertLine LineCommand = 'i'
+	// AppendLine writes the text after every selected line, like sed's `a`
+	AppendLine LineCommand = 'a'
+	// ChangeLine replaces every selected line with the text, like sed's `c`. A range is replaced as a whole once it ends.
+	ChangeLine LineCommand = 'c'
+	// DeleteLine drops every selected line, like sed's `d`
+	DeleteLine LineCommand = 'd'
+)
+
+// commandEditor applies a LineCommand to the selected lines
+type commandEditor struct {
+	command LineCommand
+	text    []byte
+	lines   int
+}
+
+// editLine implements lineEditor
+func (e *commandEditor) editLine(out *bytes.Buffer, line, terminator []byte, selected, end bool) {
+	switch selected {
+	case false:
+		out.Write(line)
+		out.Write(terminator)
+		return
+	}
+	e.lines++
+	switch e.command {
+	case InsertLine:
+		out.Write(e.text)
+		out.WriteByte('\n')
+		out.Write(line)
+		out.Write(terminator)
+	case AppendLine:
+		// The text always ends with a newline like in sed, even after a last line without one
+		out.Write(line)
+		out.WriteByte('\n')
+		out.Write(e.text)
+		out.WriteByte('\n')
+	case ChangeLine:
+		switch end {
+		case true:
+			out.Write(e.text)
+			out.WriteByte('\n')
+		}
+	}
+}
+
+// Matches returns the number of lines the command was applied to so far
+func (e *commandEditor) Matches() int {
+	return e.lines
+}
+
+// valid returns an error if c is not a known LineCommand
+func (c LineCommand) valid() error {
+	switch c {
+	case InsertLine, AppendLine, ChangeLine, DeleteLine:
+		return nil
+	}
+	return fmt.Errorf("unknown line command %q", byte(c))
+}
+
+// NewLineCommand adds a command that edits the lines selected by a sed-style address, see Address.
+// An empty address selects every line. The text is ignored by DeleteLine.
+// Line commands take part in the chain of mappings, but cannot be applied simultaneously, in parallel or in place.
+func (t *Transformer) NewLineCommand(address string, command LineCommand, text string) error {
+	switch err := command.valid(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch {
+	case strings.TrimSpace(address) != "":
+		_, err := ParseAddress(address)
+		switch err {
+		case nil:
+			break
+		default:
+			return err
+		}
+	}
+	t.Mappings.Keys = append(t.Mappings.Keys, []byte(address))
+	t.Mappings.Indices = append(t.Mappings.Indices, []byte(text))
+	t.Mappings.Regexps = append(t.Mappings.Regexps, nil)
+	t.Mappings.Options = append(t.Mappings.Options, nil)
+	t.Mappings.Commands = append(t.Mappings.Commands, command)
+	return nil
+}
+
+// NewLineCommandString adds a line command written like in a sed script, such as `/^\[server\]/a port=80`,
+// `$a\last line`, `5,10d` or `/debug/c removed`.
+func (t *Transformer) NewLineCommandString(expr string) error {
+	address, command, text, err := parseLineCommand(expr)
+	switch err {
+	case nil:
+		return t.NewLineCommand(address, command, text)
+	default:
+		return err
+	}
+}
+
+// parseLineCommand splits a sed-style line command into its address, command and text
+func parseLineCommand(expr string) (string, LineCommand, string, error) {
+	expr = strings.TrimLeft(expr, " \t")
+	_, rest, err := parseAddress(expr, &regexScope{syntax: syntaxGo})
+	switch {
+	case err != nil:
+		return "", 0, "", err
+	case rest == "":
+		return "", 0, "", fmt.Errorf("missing command in %q", expr)
+	}
+	address := strings.TrimSpace(expr[:len(expr)-len(rest)])
+	command := LineCommand(rest[0])
+	switch err := command.valid(); err {
+	case nil:
+		break
+	default:
+		return "", 0, "", err
+	}
+	text := rest[1:]
+	switch {
+	case command == DeleteLine && strings.TrimSpace(text) != "":
+		return "", 0, "", fmt.Errorf("unexpected %q after d", text)
+	case strings.HasPrefix(text, "\\\n"):
+		text = text[2:]
+	case strings.HasPrefix(text, "\\"):
+		text = text[1:]
+	default:
+		text = strings.TrimLeft(text, " \t")
+	}
+	return address, command, text, nil
+}
+
+// lineCommandStage wraps r with a reader applying the line command at index
+func (t *Transformer) lineCommandStage(index int, r io.Reader) replacingReader {
+	// The address has been validated when the command was added
+	address, _ := ParseAddress(string(t.Mappings.Keys[index]))
+	editor := &commandEditor{command: t.Mappings.Commands[index], text: t.Mappings.Indices[index]}
+	return newLineReplacingReader(r, address, editor)
+}
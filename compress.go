@@ -0,0 +1,356 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Compression selects how the Replacer treats compressed files
+type Compression int
+
+const (
+	// CompressionNone replaces the bytes of the file as they are, which is the default
+	CompressionNone Compression = iota
+	// CompressionAuto detects the compression of the file by its magic bytes, uncompressed files are replaced as they are
+	CompressionAuto
+	// CompressionGzip treats the file as gzip compressed
+	CompressionGzip
+	// CompressionZstd treats the file as zstd compressed
+	CompressionZstd
+	// CompressionBzip2 treats the file as bzip2 compressed
+	CompressionBzip2
+	// CompressionXz treats the file as xz compressed
+	CompressionXz
+)
+
+// compressionSniffLen is the length of the header checked by DetectCompression, which a bzip2 stream needs in full
+const compressionSniffLen = 10
+
+// magics are the magic bytes every compressed file starts with. Those of bzip2 are checked by isBzip2 instead, as
+// they are plain text.
+var magics = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// String returns the name of the compression
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionAuto:
+		return "auto"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionBzip2:
+		return "bzip2"
+	case CompressionXz:
+		return "xz"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// Codec decompresses and recompresses the files of a single compression format. Both sides are streamed, so a
+// file is never held in memory as a whole.
+type Codec interface {
+	// NewReader returns a reader of the decompressed content of r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer that compresses to w. The content is compressed like the content read through
+	// original (which was returned by NewReader) was, with a comparable level and the same metadata as far as the
+	// format records them. Closing the writer flushes it without closing w.
+	NewWriter(w io.Writer, original io.ReadCloser) (io.WriteCloser, error)
+}
+
+// codecs holds the Codec of every compression that is supported
+var codecs = struct {
+	sync.RWMutex
+	m map[Compression]Codec
+}{m: map[Compression]Codec{
+	CompressionGzip:  gzipCodec{},
+	CompressionZstd:  zstdCodec{},
+	CompressionBzip2: bzip2Codec{},
+	CompressionXz:    xzCodec{},
+}}
+
+// RegisterCodec makes compression supported by codec, replacing the one it had, for instance to compress with other
+// settings than the built-in codecs.
+func RegisterCodec(compression Compression, codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[compression] = codec
+}
+
+// lookupCodec returns the Codec registered for compression
+func lookupCodec(compression Compression) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	switch codec, ok := codecs.m[compression]; ok {
+	case true:
+		return codec, nil
+	}
+	return nil, fmt.Errorf("%s compressed files are not supported", compression.String())
+}
+
+// DetectCompression returns the compression indicated by the magic bytes at the start of header, or CompressionNone
+func DetectCompression(header []byte) Compression {
+	switch isBzip2(header) {
+	case true:
+		return CompressionBzip2
+	}
+	for _, m := range magics {
+		switch bytes.HasPrefix(header, m.magic) {
+		case true:
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// isBzip2 reports whether header starts a bzip2 stream: "BZh", the block size from 1 to 9 and the magic of the first
+// block, or of the end of the stream if it is empty
+func isBzip2(header []byte) bool {
+	switch {
+	case len(header) < compressionSniffLen || !bytes.HasPrefix(header, []byte("BZh")) || header[3] < '1' || header[3] > '9':
+		return false
+	}
+	var magic uint64
+	for _, b := range header[4:10] {
+		magic = magic<<8 | uint64(b)
+	}
+	return magic == bzip2BlockMagic || magic == bzip2EndMagic
+}
+
+// resolveCompression returns the compression of the file at path, detecting it if compression is CompressionAuto
+func resolveCompression(path string, compression Compression) (Compression, error) {
+	switch compression {
+	case CompressionAuto:
+		break
+	default:
+		return compression, nil
+	}
+	fi, err := os.Open(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return CompressionNone, err
+	}
+	defer func(fi *os.File) {
+		_ = fi.Close()
+	}(fi)
+	header := make([]byte, compressionSniffLen)
+	n, err := io.ReadFull(fi, header)
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		return DetectCompression(header[:n]), nil
+	default:
+		return CompressionNone, err
+	}
+}
+
+// codec returns the compression of the file according to Config.Compression and its Codec, which is nil if the file
+// is not compressed
+func (rp *Replacer) codec() (Compression, Codec, error) {
+	compression, err := resolveCompression(rp.Config.FilePath, rp.Config.Compression)
+	switch {
+	case err != nil:
+		return CompressionNone, nil, err
+	case compression == CompressionNone:
+		return CompressionNone, nil, nil
+	}
+	codec, err := lookupCodec(compression)
+	return compression, codec, err
+}
+
+// compressed reports whether the file is compressed according to Config.Compression, and the error that makes it
+// impossible to tell
+func (rp *Replacer) compressed() (bool, error) {
+	compression, err := resolveCompression(rp.Config.FilePath, rp.Config.Compression)
+	return compression != CompressionNone, err
+}
+
+// decompress returns a reader of the decompressed content of r, or r itself if codec is nil
+func decompress(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case nil:
+		return ioutil.NopCloser(r), nil
+	}
+	return codec.NewReader(r)
+}
+
+// gzipCodec is the built-in Codec of CompressionGzip
+type gzipCodec struct{}
+
+// gzipReader is a gzip.Reader that remembers the level the content was compressed with
+type gzipReader struct {
+	*gzip.Reader
+	level int
+}
+
+// NewReader implements the `Codec` interface.
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	level := gzip.DefaultCompression
+	// The XFL byte of the header tells the fastest and the best compression apart from the others
+	switch header, _ := br.Peek(10); {
+	case len(header) == 10 && header[8] == 2:
+		level = gzip.BestCompression
+	case len(header) == 10 && header[8] == 4:
+		level = gzip.BestSpeed
+	}
+	zr, err := gzip.NewReader(br)
+	switch err {
+	case nil:
+		return &gzipReader{Reader: zr, level: level}, nil
+	default:
+		return nil, err
+	}
+}
+
+// NewWriter implements the `Codec` interface. The name, comment, extra field, modification time and OS of the
+// original header are kept.
+func (gzipCodec) NewWriter(w io.Writer, original io.ReadCloser) (io.WriteCloser, error) {
+	level := gzip.DefaultCompression
+	var header *gzip.Header
+	switch zr := original.(type) {
+	case *gzipReader:
+		level = zr.level
+		header = &zr.Header
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	switch {
+	case err != nil:
+		return nil, err
+	case header != nil:
+		zw.Header = *header
+	}
+	return zw, nil
+}
+
+// zstdCodec is the built-in Codec of CompressionZstd
+type zstdCodec struct{}
+
+// zstdReader closes the zstd.Decoder it reads from
+type zstdReader struct {
+	io.Reader
+	decoder *zstd.Decoder
+}
+
+// Close implements the `io.Closer` interface.
+func (zr *zstdReader) Close() error {
+	zr.decoder.Close()
+	return nil
+}
+
+// NewReader implements the `Codec` interface.
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	switch err {
+	case nil:
+		return &zstdReader{Reader: decoder, decoder: decoder}, nil
+	default:
+		return nil, err
+	}
+}
+
+// NewWriter implements the `Codec` interface. Frames do not record the level they were compressed with, so the
+// default one is used.
+func (zstdCodec) NewWriter(w io.Writer, _ io.ReadCloser) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+}
+
+// bzip2Codec is the built-in Codec of CompressionBzip2
+type bzip2Codec struct{}
+
+// bzip2Reader remembers the block size the content was compressed with
+type bzip2Reader struct {
+	io.Reader
+	level int
+}
+
+// Close implements the `io.Closer` interface.
+func (*bzip2Reader) Close() error {
+	return nil
+}
+
+// NewReader implements the `Codec` interface.
+func (bzip2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	level := 9
+	switch header, _ := br.Peek(4); {
+	case len(header) == 4 && header[3] >= '1' && header[3] <= '9':
+		level = int(header[3] - '0')
+	}
+	return &bzip2Reader{Reader: bzip2.NewReader(br), level: level}, nil
+}
+
+// NewWriter implements the `Codec` interface. The block size of the original is kept.
+func (bzip2Codec) NewWriter(w io.Writer, original io.ReadCloser) (io.WriteCloser, error) {
+	level := 9
+	switch zr := original.(type) {
+	case *bzip2Reader:
+		level = zr.level
+	}
+	return newBzip2Writer(w, level)
+}
+
+// xzCodec is the built-in Codec of CompressionXz
+type xzCodec struct{}
+
+// xzReader remembers the integrity check of the stream it reads
+type xzReader struct {
+	*xz.Reader
+	check byte
+}
+
+// Close implements the `io.Closer` interface.
+func (*xzReader) Close() error {
+	return nil
+}
+
+// NewReader implements the `Codec` interface.
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	check := byte(xz.CRC64)
+	// The second byte of the stream flags, after the magic bytes, selects the integrity check
+	switch header, _ := br.Peek(8); {
+	case len(header) == 8:
+		check = header[7] & 0x0f
+	}
+	zr, err := xz.NewReader(br)
+	switch err {
+	case nil:
+		return &xzReader{Reader: zr, check: check}, nil
+	default:
+		return nil, err
+	}
+}
+
+// NewWriter implements the `Codec` interface. The integrity check of the original is kept, and the default
+// dictionary size is used.
+func (xzCodec) NewWriter(w io.Writer, original io.ReadCloser) (io.WriteCloser, error) {
+	config := xz.WriterConfig{CheckSum: xz.CRC64}
+	switch zr := original.(type) {
+	case *xzReader:
+		config.CheckSum = zr.check
+	}
+	return config.NewWriter(w)
+}
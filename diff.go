@@ -0,0 +1,266 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around every change
+	diffContext = 3
+	// diffWindow is the number of lines buffered from each side when looking for the end of a change
+	diffWindow = 512
+)
+
+// lineSource buffers lines read from a stream for the diff
+type lineSource struct {
+	r     *bufio.Reader
+	lines [][]byte
+	read  int64
+	err   error
+}
+
+// fill buffers lines until at least n are available or the stream is exhausted
+func (s *lineSource) fill(n int) error {
+	for len(s.lines) < n && s.err == nil {
+		line, err := s.r.ReadBytes('\n')
+		s.read += int64(len(line))
+		switch len(line) {
+		case 0:
+			break
+		default:
+			s.lines = append(s.lines, line)
+		}
+		s.err = err
+	}
+	switch s.err {
+	case nil, io.EOF:
+		return nil
+	default:
+		return s.err
+	}
+}
+
+// pop drops the first n buffered lines
+func (s *lineSource) pop(n int) {
+	s.lines = s.lines[:copy(s.lines, s.lines[n:])]
+}
+
+// differ assembles hunks of a unified diff as changes are streamed into it
+type differ struct {
+	w              io.Writer
+	header         []byte   // file header, written before the first hunk
+	aNext, bNext   int      // line numbers of the next line on either side
+	before         [][]byte // unchanged lines preceding the next hunk
+	after          [][]byte // unchanged lines following the last change of the current hunk
+	hunk           bytes.Buffer
+	inHunk         bool
+	aStart, bStart int
+	aCount, bCount int
+	changed        bool
+}
+
+// unifiedDiff streams a unified diff between a (the original content) and b (the rewritten content) into w.
+// Unchanged lines are matched up greedily within a window of diffWindow lines, so the output is always a valid
+// patch but not necessarily the shortest one. It returns the number of bytes read from b and whether anything changed.
+func unifiedDiff(w io.Writer, name string, a, b io.Reader) (int64, bool, error) {
+	as := &lineSource{r: bufio.NewReaderSize(a, 8192)}
+	bs := &lineSource{r: bufio.NewReaderSize(b, 8192)}
+	d := &differ{
+		w:      w,
+		header: []byte(fmt.Sprintf("--- %s\n+++ %s\n", name, name)),
+		aNext:  1,
+		bNext:  1,
+	}
+	for {
+		for _, s := range []*lineSource{as, bs} {
+			switch err := s.fill(1); err {
+			case nil:
+				break
+			default:
+				return bs.read, d.changed, err
+			}
+		}
+		switch {
+		case len(as.lines) == 0 && len(bs.lines) == 0:
+			return bs.read, d.changed, d.close()
+		case len(as.lines) > 0 && len(bs.lines) > 0 && bytes.Equal(as.lines[0], bs.lines[0]):
+			switch err := d.equal(as.lines[0]); err {
+			case nil:
+				break
+			default:
+				return bs.read, d.changed, err
+			}
+			as.pop(1)
+			bs.pop(1)
+			continue
+		}
+		for _, s := range []*lineSource{as, bs} {
+			switch err := s.fill(diffWindow); err {
+			case nil:
+				break
+			default:
+				return bs.read, d.changed, err
+			}
+		}
+		i, j := resync(as.lines, bs.lines)
+		d.change(as.lines[:i], bs.lines[:j])
+		as.pop(i)
+		bs.pop(j)
+	}
+}
+
+// resync returns the number of lines from a and b that make up the change at their start, which is the
+// closest point where both sides agree again for up to diffContext lines.
+func resync(a, b [][]byte) (int, int) {
+	for k := 1; k < len(a)+len(b); k++ {
+		for i := 0; i <= k; i++ {
+			j := k - i
+			switch {
+			case i >= len(a) || j >= len(b):
+				continue
+			}
+			n := len(a) - i
+			switch {
+			case len(b)-j < n:
+				n = len(b) - j
+			}
+			switch {
+			case n > diffContext:
+				n = diffContext
+			}
+			equal := true
+			for l := 0; l < n && equal; l++ {
+				equal = bytes.Equal(a[i+l], b[j+l])
+			}
+			switch equal {
+			case true:
+				return i, j
+			}
+		}
+	}
+	return len(a), len(b)
+}
+
+// writeLine writes a single diff line with the given prefix
+func (d *differ) writeLine(prefix byte, line []byte) {
+	d.hunk.WriteByte(prefix)
+	d.hunk.Write(line)
+	switch {
+	case len(line) == 0 || line[len(line)-1] != '\n':
+		d.hunk.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// equal records an unchanged line
+func (d *differ) equal(line []byte) error {
+	d.aNext++
+	d.bNext++
+	switch d.inHunk {
+	case false:
+		d.before = append(d.before, line)
+		switch {
+		case len(d.before) > diffContext:
+			d.before = d.before[1:]
+		}
+		return nil
+	}
+	d.after = append(d.after, line)
+	switch {
+	case len(d.after) > 2*diffContext:
+		// Too far from the next change to share a hunk with it
+		return d.close()
+	}
+	return nil
+}
+
+// change records a run of removed and added lines
+func (d *differ) change(removed, added [][]byte) {
+	d.changed = true
+	switch d.inHunk {
+	case false:
+		d.inHunk = true
+		d.aStart = d.aNext - len(d.before)
+		d.bStart = d.bNext - len(d.before)
+		d.aCount = 0
+		d.bCount = 0
+		d.after = append(d.after[:0], d.before...)
+		d.before = d.before[:0]
+	}
+	for _, line := range d.after {
+		d.writeLine(' ', line)
+	}
+	d.aCount += len(d.after)
+	d.bCount += len(d.after)
+	d.after = d.after[:0]
+	for _, line := range removed {
+		d.writeLine('-', line)
+	}
+	for _, line := range added {
+		d.writeLine('+', line)
+	}
+	d.aCount += len(removed)
+	d.bCount += len(added)
+	d.aNext += len(removed)
+	d.bNext += len(added)
+}
+
+// close writes out the current hunk, if any
+func (d *differ) close() error {
+	switch d.inHunk {
+	case false:
+		return nil
+	}
+	n := len(d.after)
+	switch {
+	case n > diffContext:
+		n = diffContext
+	}
+	for _, line := range d.after[:n] {
+		d.writeLine(' ', line)
+	}
+	d.aCount += n
+	d.bCount += n
+	d.before = append(d.before[:0], d.after[n:]...)
+	switch {
+	case len(d.before) > diffContext:
+		d.before = d.before[len(d.before)-diffContext:]
+	}
+	d.after = d.after[:0]
+	d.inHunk = false
+	switch {
+	case d.header != nil:
+		switch _, err := d.w.Write(d.header); err {
+		case nil:
+			break
+		default:
+			return err
+		}
+		d.header = nil
+	}
+	switch _, err := fmt.Fprintf(d.w, "@@ -%s +%s @@\n", hunkRange(d.aStart, d.aCount), hunkRange(d.bStart, d.bCount)); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	_, err := d.hunk.WriteTo(d.w)
+	return err
+}
+
+// hunkRange formats one side of a hunk header the way GNU diff does
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	default:
+		return fmt.Sprintf("%d,%d", start, count)
+	}
+}
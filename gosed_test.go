@@ -2,11 +2,16 @@ package gosed
 
 import (
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"github.com/carterpeel/go-corelib/ios"
 	"github.com/docker/go-units"
+	"github.com/klauspost/compress/zstd"
 	"github.com/tjarratt/babble"
+	"github.com/ulikunitz/xz"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,16 +19,18 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
 func TestTiny(t *testing.T) {
 	start := time.Now()
 	tinyBytes := []byte{'a', 'b', 'c', 'a', 'd'}
-	newBytes, err := ioutil.ReadAll(ios.NewBytesReplacingReader(bytes.NewReader(tinyBytes), []byte("a"), []byte("f")))
+	newBytes, err := ioutil.ReadAll(NewBytesReplacingReader(bytes.NewReader(tinyBytes), []byte("a"), []byte("f")))
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -34,7 +41,6 @@ func TestTiny(t *testing.T) {
 	}
 }
 
-
 func TestSmall(t *testing.T) {
 	defer Cleanup()
 	babbler := babble.NewBabbler()
@@ -75,7 +81,7 @@ func TestSmall(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	fmt.Printf("[gosed] --> replaced %d bytes in %s\n", replaced, time.Since(start))
+	fmt.Printf("[gosed] --> replaced %d bytes in %s\n", replaced.BytesWritten, time.Since(start))
 	var sedPath string
 	if runtime.GOOS == "darwin" {
 		sedPath = "gsed"
@@ -150,7 +156,7 @@ func TestSequentialSmall(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	log.Printf("replaced %d bytes in %s\n", replaced, time.Since(start))
+	log.Printf("replaced %d bytes in %s\n", replaced.BytesWritten, time.Since(start))
 }
 
 func TestFull(t *testing.T) {
@@ -219,7 +225,7 @@ func TestFull(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	log.Printf("[gosed] --> replaced %d occurrences in %s\n", replaced, time.Since(start))
+	log.Printf("[gosed] --> replaced %d occurrences in %s\n", replaced.TotalMatches(), time.Since(start))
 	var sedPath string
 	if runtime.GOOS == "darwin" {
 		sedPath = "gsed"
@@ -338,7 +344,7 @@ func TestFullSequential(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	log.Printf("[gosed] --> replaced %d occurrences in %s\n", replaced, time.Since(start))
+	log.Printf("[gosed] --> replaced %d occurrences in %s\n", replaced.TotalMatches(), time.Since(start))
 	var sedPath string
 	if runtime.GOOS == "darwin" {
 		sedPath = "gsed"
@@ -380,44 +386,1783 @@ func TestFullSequential(t *testing.T) {
 	}
 }
 
-func Cleanup() {
-	files, err := filepath.Glob("*.txt")
+func TestRegexReader(t *testing.T) {
+	var input bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		_, _ = fmt.Fprintf(&input, "line %d: foo%d bar\n", i, i*7)
+	}
+	re := regexp.MustCompile(`(?m)^line (\d+): foo(?P<num>\d+)`)
+	expected := re.ReplaceAll(input.Bytes(), []byte("${num}=$1"))
+	got, err := ioutil.ReadAll(NewRegexReplacingReader(bytes.NewReader(input.Bytes()), re, []byte("${num}=$1"), 64))
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err.Error())
 	}
-	for _, fi := range files {
-		_ = os.Remove(fi)
+	if !bytes.Equal(got, expected) {
+		t.Fatal(fmt.Errorf("regex output did not match regexp.ReplaceAll"))
 	}
-	files, err = filepath.Glob("*.sh")
+	re = regexp.MustCompile(`x*`)
+	expected = re.ReplaceAll([]byte("abxxc"), []byte("-"))
+	got, err = ioutil.ReadAll(NewRegexReplacingReader(bytes.NewReader([]byte("abxxc")), re, []byte("-"), 0))
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err.Error())
 	}
-	for _, fi := range files {
-		_ = os.Remove(fi)
+	if !bytes.Equal(got, expected) {
+		fmt.Printf("Expected: %s\nGot: %s\n", string(expected), string(got))
+		t.Fatal(fmt.Errorf("empty regex matches did not match regexp.ReplaceAll"))
+	}
+	// Without (?m), start of text anchors only match at the start of the stream, not of every window
+	input.Reset()
+	for input.Len() < 55000 {
+		input.WriteString("abcdefghij\n")
+	}
+	for _, pattern := range []string{`^a`, `\Aab|j`, `(?m:^a)|^(?P<b>b)`} {
+		re = regexp.MustCompile(pattern)
+		expected = re.ReplaceAll(input.Bytes(), []byte("X${b}"))
+		got, err = ioutil.ReadAll(NewRegexReplacingReader(bytes.NewReader(input.Bytes()), re, []byte("X${b}"), 64))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatal(fmt.Errorf("%q over several windows did not match regexp.ReplaceAll", pattern))
+		}
 	}
 }
 
-func copyFileContents(src, dst string) (err error) {
-	in, err := os.Open(src)
+func TestRegexMapping(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-regex.txt", []byte("foo1 foo22 bar foo333\n"), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-regex.txt")
 	if err != nil {
-		return
+		t.Fatal(err.Error())
 	}
-	defer func(in *os.File) {
-		_ = in.Close()
-	}(in)
-	out, err := os.Create(dst)
+	if err := replacer.NewRegexMapping(`foo(\d+)`, "bar$1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("bar22", "baz"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile("test-regex.txt")
 	if err != nil {
-		return
+		t.Fatal(err.Error())
 	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
+	if string(got) != "bar1 baz bar bar333\n" {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got))
+	}
+	if err := replacer.NewRegexMapping(`(`, "x"); err == nil {
+		t.Fatal(fmt.Errorf("invalid pattern was accepted"))
+	}
+}
+
+func TestMultiReader(t *testing.T) {
+	search := [][]byte{[]byte("a"), []byte("b"), []byte("ab"), []byte("bca"), []byte("cab")}
+	replace := [][]byte{[]byte("b"), []byte("a"), []byte("X"), []byte(""), []byte("YY")}
+	rand.Seed(time.Now().UnixNano())
+	input := make([]byte, 100000)
+	for i := range input {
+		input[i] = "abc\n"[rand.Intn(4)]
+	}
+	// Reference leftmost-longest implementation
+	var expected bytes.Buffer
+	for i := 0; i < len(input); {
+		best := -1
+		for k, key := range search {
+			if bytes.HasPrefix(input[i:], key) && (best < 0 || len(key) > len(search[best])) {
+				best = k
+			}
+		}
+		if best < 0 {
+			expected.WriteByte(input[i])
+			i++
+			continue
+		}
+		expected.Write(replace[best])
+		i += len(search[best])
+	}
+	got, err := ioutil.ReadAll(NewMultiBytesReplacingReader(bytes.NewReader(input), search, replace))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, expected.Bytes()) {
+		t.Fatal(fmt.Errorf("multi replacing reader output did not match reference"))
+	}
+}
+
+func TestSimultaneousSwap(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-swap.txt", []byte("foo bar foobar barfoo"), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-swap.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("bar", "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceSimultaneous(); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile("test-swap.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := strings.NewReplacer("foo", "bar", "bar", "foo").Replace("foo bar foobar barfoo"); string(got) != expected {
+		t.Fatal(fmt.Errorf("expected %q, got %q", expected, got))
+	}
+}
+
+func TestReplaceContextCancelled(t *testing.T) {
+	defer Cleanup()
+	original := []byte("foo bar foo bar")
+	if err := ioutil.WriteFile("test-ctx.txt", original, 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-ctx.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, replace := range []func(context.Context) (*ReplaceReport, error){replacer.ReplaceContext, replacer.ReplaceChainedContext, replacer.ReplaceSimultaneousContext} {
+		if err := replacer.NewStringMapping("foo", "baz"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("bar", "qux"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := replace(ctx); err != context.Canceled {
+			t.Fatal(fmt.Errorf("expected %v, got %v", context.Canceled, err))
+		}
+		if err := replacer.Reset(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	got, err := ioutil.ReadFile("test-ctx.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatal(fmt.Errorf("original file was modified: %q", got))
+	}
+	leftovers, err := filepath.Glob("*tmp-gosed-*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(leftovers) != 0 {
+		t.Fatal(fmt.Errorf("temporary files were left behind: %v", leftovers))
+	}
+}
+
+func TestAtomicCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test-atomic.txt")
+	if err := ioutil.WriteFile(path, []byte("foo bar foo"), 0640); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("foo", "baz"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("bar", "qux"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 1 || entries[0].Name() != "test-atomic.txt" {
+		t.Fatal(fmt.Errorf("unexpected directory contents: %v", entries))
+	}
+	if entries[0].Mode().Perm() != 0640 {
+		t.Fatal(fmt.Errorf("file mode was not preserved: %v", entries[0].Mode()))
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "baz qux baz" {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got))
+	}
+}
+
+func TestDryRunDiff(t *testing.T) {
+	defer Cleanup()
+	var input bytes.Buffer
+	rand.Seed(time.Now().UnixNano())
+	words := []string{"foo", "bar", "baz", "qux", "\n", "\n"}
+	for i := 0; i < 20000; i++ {
+		input.WriteString(words[rand.Intn(len(words))])
+	}
+	input.WriteString("foo")
+	for _, name := range []string{"test-dryrun.txt", "test-dryrun-patched.txt", "test-dryrun-real.txt"} {
+		if err := ioutil.WriteFile(name, input.Bytes(), 0777); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	mappings := [][2]string{{"foo", "FOO"}, {"bar\n", ""}, {"qux", "x\ny"}}
+	dryRun, err := NewReplacer("test-dryrun.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	real, err := NewReplacer("test-dryrun-real.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, mapping := range mappings {
+		if err := dryRun.NewStringMapping(mapping[0], mapping[1]); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := real.NewStringMapping(mapping[0], mapping[1]); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	var diff bytes.Buffer
+	dryRun.Config.DryRun = true
+	dryRun.Config.DiffOutput = &diff
+	if _, err := dryRun.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := real.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	untouched, err := ioutil.ReadFile("test-dryrun.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(untouched, input.Bytes()) {
+		t.Fatal(fmt.Errorf("dry run modified the file"))
+	}
+	if err := ioutil.WriteFile("test-dryrun.diff.txt", diff.Bytes(), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := exec.Command("patch", "-s", "test-dryrun-patched.txt", "test-dryrun.diff.txt").CombinedOutput()
+	if err != nil {
+		log.Printf("patch output: %s\n", string(out))
+		t.Fatal(err.Error())
+	}
+	patched, err := ioutil.ReadFile("test-dryrun-patched.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	replaced, err := ioutil.ReadFile("test-dryrun-real.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(patched, replaced) {
+		t.Fatal(fmt.Errorf("applying the dry run diff did not produce the replaced file"))
+	}
+}
+
+func TestChainedTail(t *testing.T) {
+	input := []byte("quxfooquxbar\nquxfoo")
+	// The outer readers see the final bytes together with io.EOF, which must not cut off their tail
+	reader := NewBytesReplacingReader(NewBytesReplacingReader(NewBytesReplacingReader(bytes.NewReader(input), []byte("foo"), []byte("FOO")), []byte("bar\n"), []byte("")), []byte("qux"), []byte("x\ny"))
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "x\nyFOOx\nyx\nyFOO" {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got))
+	}
+	if reader.Matches() != 3 {
+		t.Fatal(fmt.Errorf("expected 3 matches, got %d", reader.Matches()))
+	}
+}
+
+func TestReplaceReport(t *testing.T) {
+	defer Cleanup()
+	input := []byte("foo bar foo baz foo")
+	for _, replace := range []func(*Replacer) (*ReplaceReport, error){(*Replacer).Replace, (*Replacer).ReplaceChained, (*Replacer).ReplaceSimultaneous} {
+		if err := ioutil.WriteFile("test-report.txt", input, 0777); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer("test-report.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, mapping := range [][2]string{{"foo", "x"}, {"qux", "y"}, {"baz", "zz"}} {
+			if err := replacer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		report, err := replace(replacer)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fmt.Sprint(report.Matches) != "[3 0 1]" {
+			t.Fatal(fmt.Errorf("unexpected matches: %v", report.Matches))
+		}
+		if report.BytesRead != int64(len(input)) || report.BytesWritten != int64(len("x bar x zz x")) {
+			t.Fatal(fmt.Errorf("unexpected byte counts: read %d, wrote %d", report.BytesRead, report.BytesWritten))
+		}
+		if report.TempPath == "" || report.TotalMatches() != 4 {
+			t.Fatal(fmt.Errorf("incomplete report: %+v", report))
+		}
+	}
+}
+
+func TestTransformer(t *testing.T) {
+	transformer := NewTransformer()
+	if err := transformer.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := transformer.NewStringMapping("bar", "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	input := []byte(strings.Repeat("foo bar baz ", 10000))
+	if got := transformer.Bytes(input); !bytes.Equal(got, bytes.ReplaceAll(input, []byte("bar"), []byte("foo"))) {
+		t.Fatal(fmt.Errorf("chained Bytes() did not apply the mappings in order"))
+	}
+	transformer.Simultaneous = true
+	expected := []byte(strings.Repeat("bar foo baz ", 10000))
+	got, err := ioutil.ReadAll(transformer.Reader(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal(fmt.Errorf("simultaneous Reader() did not swap the mappings"))
+	}
+	var output bytes.Buffer
+	writer := transformer.Writer(&output)
+	// Write in odd sized pieces so that matches straddle writes
+	for i := 0; i < len(input); i += 7 {
+		end := i + 7
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := writer.Write(input[i:end]); err != nil {
+			t.Fatal(err.Error())
 		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Closing again returns at once
+	if err := writer.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(output.Bytes(), expected) {
+		t.Fatal(fmt.Errorf("simultaneous Writer() did not swap the mappings"))
+	}
+	if err := transformer.NewRegexMapping(`b(a)z`, "$1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ioutil.ReadAll(transformer.Reader(bytes.NewReader(input))); err == nil {
+		t.Fatal(fmt.Errorf("regular expressions were accepted in simultaneous mode"))
+	}
+}
+
+func TestTreeReplacer(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "build/\n*.log\n!keep.log\n",
+		"a.txt":               "foo",
+		"keep.log":            "foo",
+		"drop.log":            "foo",
+		"build/c.txt":         "foo",
+		"bin.dat":             "foo\x00",
+		".git/config":         "foo",
+		"sub/b.go":            "foo",
+		"sub/.gitignore":      "/secret.txt\n",
+		"sub/secret.txt":      "foo",
+		"sub/deep/secret.txt": "foo",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	tree := NewTreeReplacer(root)
+	tree.Exclude = append(tree.Exclude, "*.gitignore")
+	if err := tree.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	reports, err := tree.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	replaced := make([]string, 0)
+	for _, report := range reports {
+		if report.Err != nil {
+			t.Fatal(report.Err.Error())
+		}
+		if report.Report.TotalMatches() != 1 {
+			t.Fatal(fmt.Errorf("%s: expected 1 match, got %d", report.Path, report.Report.TotalMatches()))
+		}
+		rel, _ := filepath.Rel(root, report.Path)
+		replaced = append(replaced, filepath.ToSlash(rel))
+	}
+	if fmt.Sprint(replaced) != "[a.txt keep.log sub/b.go sub/deep/secret.txt]" {
+		t.Fatal(fmt.Errorf("unexpected files replaced: %v", replaced))
+	}
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := content
+		for _, rel := range replaced {
+			if rel == name {
+				expected = "bar"
+			}
+		}
+		if string(got) != expected {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", name, expected, got))
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	root := t.TempDir()
+	paths := make([]string, 0)
+	for i := 0; i < 16; i++ {
+		path := filepath.Join(root, fmt.Sprintf("%02d.txt", i))
+		if err := ioutil.WriteFile(path, []byte(strings.Repeat("foo ", i+1)), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, filepath.Join(root, "missing.txt"))
+	transformer := NewTransformer()
+	if err := transformer.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	pool := NewPool(4)
+	errs := make(chan error, 1)
+	go func() {
+		for _, path := range paths {
+			pool.SubmitFile(context.Background(), path, transformer)
+		}
+		errs <- pool.Close()
 	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
+	var total, failed int
+	for report := range pool.Results() {
+		switch report.Err {
+		case nil:
+			total += report.Report.TotalMatches()
+		default:
+			failed++
+		}
 	}
-	err = out.Sync()
-	return
-}
\ No newline at end of file
+	err := <-errs
+	if failed != 1 || total != 136 {
+		t.Fatal(fmt.Errorf("expected 136 matches and 1 failure, got %d matches and %d failures", total, failed))
+	}
+	if replaceErrs, ok := err.(ReplaceErrors); !ok || len(replaceErrs) != 1 || replaceErrs[0].Path != paths[16] {
+		t.Fatal(fmt.Errorf("expected the missing file to be reported, got %v", err))
+	}
+	for i, path := range paths[:16] {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != strings.Repeat("bar ", i+1) {
+			t.Fatal(fmt.Errorf("%s was not replaced: %q", path, got))
+		}
+	}
+	// The reports of a concurrent tree are still in walk order, and so are the diffs
+	tree := NewTreeReplacer(root)
+	tree.Concurrency = 4
+	tree.DryRun = true
+	var diff bytes.Buffer
+	tree.DiffOutput = &diff
+	if err := tree.NewStringMapping("bar", "baz"); err != nil {
+		t.Fatal(err.Error())
+	}
+	reports, err := tree.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, report := range reports {
+		if report.Path != paths[i] || report.Err != nil {
+			t.Fatal(fmt.Errorf("unexpected report %d: %s (%v)", i, report.Path, report.Err))
+		}
+	}
+	if strings.Count(diff.String(), "+++ ") != 16 || strings.Count(diff.String(), "@@ -1 +1 @@\n-bar") != 16 {
+		t.Fatal(fmt.Errorf("diffs of concurrent files interleaved:\n%s", diff.String()))
+	}
+}
+
+func TestParallelReplace(t *testing.T) {
+	rnd := rand.New(rand.NewSource(11))
+	content := make([]byte, 1<<16)
+	for i := range content {
+		content[i] = "aab\n"[rnd.Intn(4)]
+	}
+	for _, chunkSize := range []int64{1, 3, 7, 4096, 0} {
+		path := filepath.Join(t.TempDir(), "parallel.txt")
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		transformer := NewTransformer()
+		transformer.Simultaneous = true
+		replacer, err := NewReplacer(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer.Config.ChunkSize = chunkSize
+		for _, mapping := range [][2]string{{"aaa", "X"}, {"aa", "YY"}, {"ab", ""}, {"b\na", "ba\n"}} {
+			if err := transformer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := replacer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expected, err := ioutil.ReadAll(transformer.Reader(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		report, err := replacer.ReplaceParallel(4)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = replacer.Close()
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatal(fmt.Errorf("chunk size %d: parallel output differs from the simultaneous one", chunkSize))
+		}
+		if report.BytesWritten != int64(len(expected)) || fmt.Sprint(report.Matches) == "[0 0 0 0]" {
+			t.Fatal(fmt.Errorf("chunk size %d: unexpected report %+v", chunkSize, report))
+		}
+	}
+}
+
+func TestReplaceInPlace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test-inplace.txt")
+	content := strings.Repeat("id=1234 flag=off\n", 4096)
+	if err := ioutil.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err.Error())
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("1234", "XXXX"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("off", "on "); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := replacer.ReplaceInPlace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.TotalMatches() != 8192 || report.TempPath != "" {
+		t.Fatal(fmt.Errorf("unexpected report: %+v", report))
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != strings.Repeat("id=XXXX flag=on \n", 4096) {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got[:64]))
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !os.SameFile(before, after) {
+		t.Fatal(fmt.Errorf("the file was replaced instead of being rewritten in place"))
+	}
+	if err := replacer.NewStringMapping("on ", "on!!"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceInPlace(); err == nil {
+		t.Fatal(fmt.Errorf("expected a longer replacement to be refused"))
+	}
+	// Once the file has been renamed over, the in-place replace rewrites the new file rather than the original
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("on!!", "ON!!"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err = replacer.ReplaceInPlace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.TotalMatches() != 4096 || string(got) != strings.Repeat("id=XXXX flag=ON!!\n", 4096) {
+		t.Fatal(fmt.Errorf("the in-place replace after a chained one was lost: %d matches, %q", report.TotalMatches(), got[:64]))
+	}
+	_ = replacer.Close()
+}
+
+func TestShrinkInPlace(t *testing.T) {
+	rnd := rand.New(rand.NewSource(13))
+	var content bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		switch rnd.Intn(3) {
+		case 0:
+			content.WriteString("DEBUG: ")
+		}
+		content.WriteString(fmt.Sprintf("line %d abc\n", rnd.Intn(1000)))
+	}
+	for _, simultaneous := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test-shrink.txt")
+		if err := ioutil.WriteFile(path, content.Bytes(), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		before, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer.Config.InPlace = true
+		transformer := NewTransformer()
+		for _, mapping := range [][2]string{{"DEBUG: ", ""}, {"abc", "ab"}, {"line", "ln"}, {"ln 1", "LN 1"}} {
+			if err := replacer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := transformer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		transformer.Simultaneous = simultaneous
+		expected := transformer.Bytes(content.Bytes())
+		var report *ReplaceReport
+		switch simultaneous {
+		case true:
+			report, err = replacer.ReplaceSimultaneous()
+		default:
+			report, err = replacer.ReplaceChained()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = replacer.Close()
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(got, expected) || report.BytesWritten != int64(len(expected)) || report.TempPath != "" {
+			t.Fatal(fmt.Errorf("simultaneous=%v: unexpected output of %d bytes, expected %d", simultaneous, len(got), len(expected)))
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !os.SameFile(before, after) {
+			t.Fatal(fmt.Errorf("the file was replaced instead of being compacted in place"))
+		}
+	}
+}
+
+func TestMmapEngine(t *testing.T) {
+	rnd := rand.New(rand.NewSource(17))
+	content := make([]byte, 1<<17)
+	for i := range content {
+		content[i] = "abcd\n"[rnd.Intn(5)]
+	}
+	mappings := [][2]string{{"abc", "X"}, {"ab", "abab"}, {"d\n", ""}, {"XX", "Y"}}
+	replace := func(engine Engine, mode int, content []byte) ([]byte, *ReplaceReport) {
+		path := filepath.Join(t.TempDir(), "test-mmap.txt")
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer func(replacer *Replacer) {
+			_ = replacer.Close()
+		}(replacer)
+		replacer.Config.Engine = engine
+		for _, mapping := range mappings {
+			if err := replacer.NewStringMapping(mapping[0], mapping[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		var report *ReplaceReport
+		switch mode {
+		case 0:
+			report, err = replacer.Replace()
+		case 1:
+			report, err = replacer.ReplaceChained()
+		default:
+			report, err = replacer.ReplaceSimultaneous()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return got, report
+	}
+	for mode := 0; mode < 3; mode++ {
+		expected, expectedReport := replace(EngineStream, mode, content)
+		got, report := replace(EngineMmap, mode, content)
+		if !bytes.Equal(got, expected) {
+			t.Fatal(fmt.Errorf("mode %d: mmap output differs from the streaming one", mode))
+		}
+		if fmt.Sprint(report.Matches) != fmt.Sprint(expectedReport.Matches) || report.BytesRead != int64(len(content)) {
+			t.Fatal(fmt.Errorf("mode %d: expected %v matches, got %v after reading %d bytes", mode, expectedReport.Matches, report.Matches, report.BytesRead))
+		}
+	}
+	// Empty files cannot be mapped and fall back to streaming
+	if got, _ := replace(EngineMmap, 1, nil); len(got) != 0 {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got))
+	}
+	// The first stage searches the mapped memory instead of streaming the file
+	path := filepath.Join(t.TempDir(), "test-mmap.txt")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(replacer *Replacer) {
+		_ = replacer.Close()
+	}(replacer)
+	replacer.Config.Engine = EngineMmap
+	if err := replacer.NewStringMapping("abc", "X"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, wrap := range map[string]func(io.Reader) (*pipeline, error){
+		"chained":      replacer.Config.Transformer.chain,
+		"simultaneous": replacer.Config.Transformer.simultaneous,
+	} {
+		input, err := replacer.openSource(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		stage, err := wrap(input.plain())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, ok := stage.Reader.(*mappedReplacingReader); !ok || input.mapped == nil {
+			t.Fatal(fmt.Errorf("%s: expected the mapped file to be searched in memory, got a %T", name, stage.Reader))
+		}
+		_ = input.Close()
+	}
+}
+
+func TestFoldMapping(t *testing.T) {
+	cases := []struct {
+		key, value, input, expected string
+		options                     MappingOptions
+	}{
+		{"error", "warning", "Error ERROR error eRRor", "warning warning warning warning", MappingOptions{IgnoreCase: true}},
+		{"foo", "bar", "Foo FOO foo fOo", "Bar BAR bar bar", MappingOptions{IgnoreCase: true, PreserveCase: true}},
+		{"key", "id", "\u212aey KEY", "\u212aey id", MappingOptions{IgnoreCase: true}},
+		{"key", "id", "\u212aey KEY", "id id", MappingOptions{FoldCase: true}},
+		{"straße", "road", "STRAẞE Straße", "ROAD Road", MappingOptions{FoldCase: true, PreserveCase: true}},
+		{"Foo", "bar", "Foo foo", "bar foo", MappingOptions{}},
+		{"id", "user_id", "id valid idle id,(id) id_x\nid", "user_id valid idle user_id,(user_id) id_x\nuser_id", MappingOptions{WholeWord: true}},
+		{"id", "uid", "id_x ID idé xid", "uid_x uid idé xid", MappingOptions{WholeWord: true, WordChars: "a-z\x80-\xff", IgnoreCase: true}},
+	}
+	for _, c := range cases {
+		transformer := NewTransformer()
+		if err := transformer.NewMappingWithOptions([]byte(c.key), []byte(c.value), c.options); err != nil {
+			t.Fatal(err.Error())
+		}
+		// Reading one byte at a time puts every match across a buffer refill
+		got, err := ioutil.ReadAll(transformer.Reader(iotest.OneByteReader(strings.NewReader(c.input))))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != c.expected {
+			t.Fatal(fmt.Errorf("%q with %+v: expected %q, got %q", c.key, c.options, c.expected, got))
+		}
+	}
+	// Long enough for matches and their boundaries to straddle buffer refills
+	rnd := rand.New(rand.NewSource(19))
+	var input strings.Builder
+	for input.Len() < 1<<18 {
+		input.WriteString([]string{"id", "ID", " ", "valid", "x", "\n"}[rnd.Intn(6)])
+	}
+	transformer := NewTransformer()
+	if err := transformer.NewMappingWithOptions([]byte("id"), []byte("user_id"), MappingOptions{WholeWord: true, IgnoreCase: true}); err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadAll(transformer.Reader(strings.NewReader(input.String())))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := regexp.MustCompile(`(?i)\bid\b`).ReplaceAllString(input.String(), "user_id"); string(got) != expected {
+		t.Fatal(fmt.Errorf("whole word replacement across buffer refills differs from the regular expression one"))
+	}
+	transformer = NewTransformer()
+	transformer.Simultaneous = true
+	if err := transformer.NewMappingWithOptions([]byte("a"), []byte("b"), MappingOptions{IgnoreCase: true}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ioutil.ReadAll(transformer.Reader(strings.NewReader("a"))); err == nil {
+		t.Fatal(fmt.Errorf("expected mappings with options to be refused in simultaneous mode"))
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	cases := []struct {
+		occurrence Occurrence
+		expected   string
+		matches    int
+	}{
+		{Occurrence{}, "x=b b b b b b b", 7},
+		{Occurrence{Mode: OccurrenceFirst, N: 2}, "x=b b a a a a a", 2},
+		{Occurrence{Mode: OccurrenceNth, N: 3}, "x=a a b a a a a", 1},
+		{Occurrence{Mode: OccurrenceEvery, N: 3}, "x=a a b a a b a", 2},
+		{Occurrence{Mode: OccurrenceFrom, N: 6}, "x=a a a a a b b", 2},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "test-occurrence.txt")
+		if err := ioutil.WriteFile(path, []byte("x=a a a a a a a"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewMappingWithOptions([]byte("a"), []byte("b"), MappingOptions{Occurrence: c.occurrence}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("x", "y"); err != nil {
+			t.Fatal(err.Error())
+		}
+		report, err := replacer.ReplaceChained()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = replacer.Close()
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != "y"+c.expected[1:] || report.Matches[0] != c.matches || report.Matches[1] != 1 {
+			t.Fatal(fmt.Errorf("%+v: expected %q with %d matches, got %q with %v", c.occurrence, c.expected, c.matches, got, report.Matches))
+		}
+	}
+	if err := NewTransformer().NewMappingWithOptions([]byte("a"), []byte("b"), MappingOptions{Occurrence: Occurrence{Mode: OccurrenceNth}}); err == nil {
+		t.Fatal(fmt.Errorf("expected an occurrence without N to be refused"))
+	}
+}
+
+func TestAddress(t *testing.T) {
+	var input strings.Builder
+	for i := 1; i <= 10; i++ {
+		input.WriteString(fmt.Sprintf("line %d\n", i))
+	}
+	cases := map[string]string{
+		"3":           "[3]",
+		"$":           "[10]",
+		"/5/":         "[5]",
+		"2,4":         "[2 3 4]",
+		"4,2":         "[4]",
+		"/3/,+2":      "[3 4 5]",
+		"0~3":         "[3 6 9]",
+		"2~3":         "[2 5 8]",
+		"7,~4":        "[7 8]",
+		"8,~4":        "[8]",
+		"0,/line 1/":  "[1]",
+		"1,/line 1/":  "[1 2 3 4 5 6 7 8 9 10]",
+		"/2/,/4/!":    "[1 5 6 7 8 9 10]",
+		"\\,LINE 9,I": "[9]",
+		"9,$":         "[9 10]",
+	}
+	for address, expected := range cases {
+		transformer := NewTransformer()
+		if err := transformer.NewMappingWithOptions([]byte("line "), []byte(""), MappingOptions{Lines: address}); err != nil {
+			t.Fatal(fmt.Errorf("%s: %s", address, err.Error()))
+		}
+		selected := make([]string, 0)
+		for _, line := range strings.Split(strings.TrimSuffix(string(transformer.Bytes([]byte(input.String()))), "\n"), "\n") {
+			if !strings.HasPrefix(line, "line") {
+				selected = append(selected, line)
+			}
+		}
+		if fmt.Sprint(selected) != expected {
+			t.Fatal(fmt.Errorf("%s: expected lines %s, got %v", address, expected, selected))
+		}
+	}
+	for _, address := range []string{"0", "1,", "/abc", "5~", "1,0", "//"} {
+		if _, err := ParseAddress(address); err == nil {
+			t.Fatal(fmt.Errorf("expected %q to be refused", address))
+		}
+	}
+	transformer := NewTransformer()
+	if err := transformer.NewRegexMappingWithOptions(`^port=\d+`, "port=2", MappingOptions{Lines: `/^\[server\]/,/^\[/`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := transformer.Bytes([]byte("[client]\nport=1\n[server]\nport=1\nhost=a\n[other]\nport=1"))
+	if string(got) != "[client]\nport=1\n[server]\nport=2\nhost=a\n[other]\nport=1" {
+		t.Fatal(fmt.Errorf("unexpected output: %q", got))
+	}
+}
+
+func TestLineCommands(t *testing.T) {
+	defer Cleanup()
+	input := "[server]\nhost=a\nport=1\n[client]\nhost=b\nlast"
+	cases := map[string]string{
+		`/^\[server\]/a port=80`: "[server]\nport=80\nhost=a\nport=1\n[client]\nhost=b\nlast",
+		`/^host/i\# host`:        "[server]\n# host\nhost=a\nport=1\n[client]\n# host\nhost=b\nlast",
+		"2,3d":                   "[server]\n[client]\nhost=b\nlast",
+		"2,3c section":           "[server]\nsection\n[client]\nhost=b\nlast",
+		"/host/c\\\nchanged":     "[server]\nchanged\nport=1\n[client]\nchanged\nlast",
+		"$a\\appended":           "[server]\nhost=a\nport=1\n[client]\nhost=b\nlast\nappended\n",
+		"$c end":                 "[server]\nhost=a\nport=1\n[client]\nhost=b\nend\n",
+		"5,$c end":               "[server]\nhost=a\nport=1\n[client]\nend\n",
+		"$i before":              "[server]\nhost=a\nport=1\n[client]\nhost=b\nbefore\nlast",
+		"$d":                     "[server]\nhost=a\nport=1\n[client]\nhost=b\n",
+		"/^\\[/!d":               "[server]\n[client]\n",
+	}
+	for expr, expected := range cases {
+		if err := ioutil.WriteFile("test-lines.txt", []byte(input), 0777); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer("test-lines.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewLineCommandString(expr); err != nil {
+			t.Fatal(fmt.Errorf("%s: %s", expr, err.Error()))
+		}
+		if _, err := replacer.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		got, err := ioutil.ReadFile("test-lines.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != expected {
+			t.Fatal(fmt.Errorf("%s: unexpected output: %q", expr, got))
+		}
+	}
+	for _, expr := range []string{"", "5", "5x text", "5d text", "/abc a"} {
+		if err := NewTransformer().NewLineCommandString(expr); err == nil {
+			t.Fatal(fmt.Errorf("expected %q to be refused", expr))
+		}
+	}
+	// Line commands run after the mappings before them and count the lines they edit
+	if err := ioutil.WriteFile("test-lines.txt", []byte(input), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-lines.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("host", "name"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewLineCommand("/^name/", DeleteLine, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := replacer.ReplaceChained()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile("test-lines.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "[server]\nport=1\n[client]\nlast" || fmt.Sprint(report.Matches) != "[2 2]" {
+		t.Fatal(fmt.Errorf("unexpected output %q with matches %v", got, report.Matches))
+	}
+}
+
+func TestScript(t *testing.T) {
+	defer Cleanup()
+	input := "one\ntwo\nthree\nfour\nfive"
+	cases := map[string]string{
+		"s/o/0/g;2d":               "0ne\nthree\nf0ur\nfive",
+		`s/\(\w\)\(\w\+\)/\2\1/`:   "neo\nwot\nhreet\nourf\nivef",
+		"#n\n/two/,/four/p":        "two\nthree\nfour\n",
+		":a;N;$!ba;s/\\n/,/g":      "one,two,three,four,five",
+		"1!G;h;$!d":                "five\nfour\nthree\ntwo\none\n",
+		"/t/{y/ot/OT/;s/$/!/};3q":  "one\nTwO!\nThree!\n",
+		"N;P;D":                    input,
+		"$a\\\nsix\n1i\\\nzero":    "zero\none\ntwo\nthree\nfour\nfive\nsix\n",
+		"/two/,/four/c\\\nchanged": "one\nchanged\nfive",
+		"s/e/E/;t\ns/$/ (no e)/":   "onE\ntwo (no e)\nthrEe\nfour (no e)\nfivE",
+		"/o/s//0/2;n;d":            "one\nthree\nfive",
+		"$!{h;d};x;G":              "four\nfive",
+	}
+	for source, expected := range cases {
+		script, err := ParseScript(source)
+		if err != nil {
+			t.Fatal(fmt.Errorf("%q: %s", source, err.Error()))
+		}
+		got, err := script.Bytes([]byte(input))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != expected {
+			t.Fatal(fmt.Errorf("%q: expected %q, got %q", source, expected, got))
+		}
+	}
+	for _, source := range []string{"k", "{p", "p}", "b nowhere", "s/a/b", "s/a/\\1/", "y/ab/c/", "w out.txt", "2p x", "s//x/", "//p", `s/\(a\)\1/x/`} {
+		if _, err := ParseScript(source); err == nil {
+			t.Fatal(fmt.Errorf("expected %q to be refused", source))
+		}
+	}
+	// Regular expressions are basic ones like in sed, or extended ones like in sed -E, and match like GNU sed's do
+	syntaxes := []struct {
+		source, input, expected string
+		extended                bool
+	}{
+		{`s/\(foo\)1/\1X/`, "foo1", "fooX", false},
+		{`s/a+b/Z/`, "aab a+b", "aab Z", false},
+		{`s/o\+/0/g`, "foo bo", "f0 b0", false},
+		{`s/a\{2\}/X/;s/^*/Y/`, "*aa", "YX", false},
+		{`s|a\|b|X|g`, "a|b ab", "X ab", false},
+		{`s.a\.b.X.g`, "a.b axb", "X X", false},
+		{`s/[[:digit:]]\+/N/;s/a$b/D/`, "x12 a$b", "xN D", false},
+		{`s/o/0/;//d`, "foo\nbar", "bar", false},
+		{`N;s/e.t/E-T/`, "one\ntwo", "onE-Two", false},
+		{`s/(o+)/[\1]/g`, "foo", "f[oo]", true},
+		{`s/a|b/X/g`, "abc", "XXc", true},
+		{`s/a\+b|\(x\)/Z/g`, "a+b (x)", "Z Z", true},
+		{`s/a|ab/X/`, "abcd", "Xcd", true},
+		{`s/(ab|a)(bc)?/[\1|\2]/`, "abcd", "[a|bc]d", true},
+		{`s/a\|ab/X/`, "abcd", "Xcd", false},
+		{`s/.*/\U&/`, "abc", "ABC", false},
+		{`s/\(\w\+\) \(\w\+\)/\u\1 \U\2\E!/g`, "hello world", "Hello WORLD!", false},
+		{`s/\w\+/\L\u&/g`, "hELLO wORLD", "Hello World", false},
+		{`s/(.)(.*)/\l\1\U\2x\Ey/`, "ÉCOLE", "éCOLEXy", true},
+	}
+	for _, c := range syntaxes {
+		parse := ParseScript
+		if c.extended {
+			parse = ParseExtendedScript
+		}
+		script, err := parse(c.source)
+		if err != nil {
+			t.Fatal(fmt.Errorf("%q: %s", c.source, err.Error()))
+		}
+		got, err := script.Bytes([]byte(c.input))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != c.expected {
+			t.Fatal(fmt.Errorf("%q on %q: expected %q, got %q", c.source, c.input, c.expected, got))
+		}
+	}
+	// Scripts run on the output of the mappings before them and are committed like any other mapping, keeping their syntax
+	if err := ioutil.WriteFile("test-script.txt", []byte(input), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-script.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("o", "0"); err != nil {
+		t.Fatal(err.Error())
+	}
+	script, err := ParseExtendedScript("/0/!d;s/^(.)/> \\1/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewScript(script); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceSimultaneous(); err == nil {
+		t.Fatal("expected scripts to be refused in simultaneous mode")
+	}
+	report, err := replacer.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile("test-script.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "> 0ne\n> tw0\n> f0ur\n" || fmt.Sprint(report.Matches) != "[3 5]" {
+		t.Fatal(fmt.Errorf("unexpected output %q with matches %v", got, report.Matches))
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup.txt")
+	writeTestFile(t, path, "v0")
+	replace := func(backup *Backup, inPlace bool, old, new string) *ReplaceReport {
+		replacer := newTestReplacer(t, path, old, new)
+		defer func() {
+			_ = replacer.Close()
+		}()
+		replacer.Config.Backup = backup
+		replaceFunc := replacer.ReplaceChained
+		if inPlace {
+			replaceFunc = replacer.ReplaceInPlace
+		}
+		report, err := replaceFunc()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return report
+	}
+	// Numbered backups rotate, keeping the newest Keep originals
+	rotating := &Backup{Suffix: ".bak", Keep: 2}
+	for version := 1; version <= 3; version++ {
+		report := replace(rotating, false, fmt.Sprintf("v%d", version-1), fmt.Sprintf("v%d", version))
+		if report.BackupPath != path+".bak.1" {
+			t.Fatal(fmt.Errorf("unexpected backup path %q", report.BackupPath))
+		}
+	}
+	expectTestFile(t, path, "v3")
+	expectTestFile(t, path+".bak.1", "v2")
+	expectTestFile(t, path+".bak.2", "v1")
+	if _, err := os.Stat(path + ".bak.3"); !os.IsNotExist(err) {
+		t.Fatal("expected the oldest backup to be removed")
+	}
+	// Files rewritten in place are copied, backups in a directory are named after the file
+	backupDir := filepath.Join(dir, "backups")
+	report := replace(&Backup{Dir: backupDir}, true, "v3", "v4")
+	expectTestFile(t, path, "v4")
+	expectTestFile(t, filepath.Join(backupDir, "backup.txt"), "v3")
+	if report.BackupPath != filepath.Join(backupDir, "backup.txt") {
+		t.Fatal(fmt.Errorf("unexpected backup path %q", report.BackupPath))
+	}
+	// A backup that would overwrite the file itself is refused before anything is replaced
+	replacer := newTestReplacer(t, path, "v4", "v5")
+	replacer.Config.Backup = &Backup{}
+	if _, err := replacer.ReplaceChained(); err == nil {
+		t.Fatal("expected a backup without Suffix, Dir or Keep to be refused")
+	}
+	_ = replacer.Close()
+	expectTestFile(t, path, "v4")
+	// Trees mirror their directories below the backup directory, which is skipped if it lies within Root
+	for _, name := range []string{path + ".bak.1", path + ".bak.2"} {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	writeTestFile(t, filepath.Join(dir, "sub", "backup.txt"), "v4")
+	tree := NewTreeReplacer(dir)
+	tree.Backup = &Backup{Dir: backupDir}
+	if err := tree.NewStringMapping("v4", "v5"); err != nil {
+		t.Fatal(err.Error())
+	}
+	reports, err := tree.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reports) != 2 {
+		t.Fatal(fmt.Errorf("expected 2 files to be replaced, got %d", len(reports)))
+	}
+	expectTestFile(t, filepath.Join(backupDir, "backup.txt"), "v4")
+	expectTestFile(t, filepath.Join(backupDir, "sub", "backup.txt"), "v4")
+}
+
+func TestTransaction(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "gosed.journal")
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	write := func(content string) {
+		for _, name := range names {
+			writeTestFile(t, filepath.Join(dir, name), content)
+		}
+	}
+	expect := func(content string, clean bool) {
+		for _, name := range names {
+			expectTestFile(t, filepath.Join(dir, name), content)
+		}
+		if !clean {
+			return
+		}
+		// Neither staged files, originals nor the journal are left behind
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(entries) != len(names) {
+			t.Fatal(fmt.Errorf("expected only %v, found %d files", names, len(entries)))
+		}
+	}
+	stage := func(tx *Transaction, backup *Backup) []*ReplaceReport {
+		reports := make([]*ReplaceReport, 0, len(names))
+		for _, name := range names {
+			replacer := newTestReplacer(t, filepath.Join(dir, name), "old", "new")
+			replacer.Config.Backup = backup
+			report, err := tx.Stage(replacer)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			_ = replacer.Close()
+			reports = append(reports, report)
+		}
+		return reports
+	}
+	write("old")
+	tx := NewTransaction(journal)
+	stage(tx, nil)
+	expect("old", false)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("new", true)
+	// A staged file that fails leaves every file untouched once the transaction is rolled back
+	write("old")
+	tx = NewTransaction(journal)
+	stage(tx, nil)
+	replacer := newTestReplacer(t, filepath.Join(dir, names[0]), "old", "newer")
+	if _, err := tx.Stage(replacer); err == nil {
+		t.Fatal("expected staging a file twice to fail")
+	}
+	_ = replacer.Close()
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("old", true)
+	// Staged files are in the journal before they are committed, so they can be cleaned up after a crash
+	tx = NewTransaction(journal)
+	stage(tx, nil)
+	staged, err := OpenJournal(journal)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if staged.Committed || len(staged.Files) != len(names) {
+		t.Fatal(fmt.Errorf("unexpected journal while staging: %+v", staged))
+	}
+	if _, err := NewTransaction(journal).Stage(newTestReplacer(t, filepath.Join(dir, names[0]), "old", "new")); err == nil {
+		t.Fatal("expected a transaction not to overwrite the journal of another one")
+	}
+	if err := staged.RollBack(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("old", true)
+	// A kept journal undoes the commit, or discards the originals. Backups are only made once the originals are
+	// discarded, so undoing the commit leaves none behind.
+	for _, rollBack := range []bool{true, false} {
+		write("old")
+		tx = NewTransaction(journal)
+		tx.KeepJournal = true
+		stage(tx, &Backup{Suffix: ".bak"})
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err.Error())
+		}
+		kept, err := OpenJournal(journal)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !kept.Committed || len(kept.Files) != len(names) {
+			t.Fatal(fmt.Errorf("unexpected journal: %+v", kept))
+		}
+		for _, entry := range kept.Files {
+			if !filepath.IsAbs(entry.Path) || !filepath.IsAbs(entry.Undo) || !filepath.IsAbs(entry.Temp) {
+				t.Fatal(fmt.Errorf("expected absolute paths in the journal, got %+v", entry))
+			}
+		}
+		if rollBack {
+			err = kept.RollBack()
+		} else {
+			err = kept.RollForward()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if rollBack {
+			expect("old", true)
+			continue
+		}
+		for _, name := range names {
+			expectTestFile(t, filepath.Join(dir, name+".bak"), "old")
+			if err := os.Remove(filepath.Join(dir, name+".bak")); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expect("new", true)
+	}
+	// Without a kept journal the backups are made by the commit
+	write("old")
+	tx = NewTransaction(journal)
+	reports := stage(tx, &Backup{Dir: filepath.Join(dir, "backups")})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for index, name := range names {
+		backup := filepath.Join(dir, "backups", name)
+		expectTestFile(t, backup, "old")
+		if reports[index].BackupPath != backup {
+			t.Fatal(fmt.Errorf("unexpected backup path %q", reports[index].BackupPath))
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "backups")); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("new", true)
+	// Trees with a journal are replaced in a single transaction
+	write("old")
+	tree := NewTreeReplacer(dir)
+	tree.Journal = journal
+	tree.Concurrency = 2
+	if err := tree.NewStringMapping("old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.ReplaceContext(ctx); err == nil {
+		t.Fatal("expected the cancelled transaction to fail")
+	}
+	expect("old", true)
+	fileReports, err := tree.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(fileReports) != len(names) {
+		t.Fatal(fmt.Errorf("expected %d reports, got %d", len(names), len(fileReports)))
+	}
+	expect("new", true)
+}
+
+func TestLock(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		break
+	default:
+		t.Skip("file locking is not supported on " + runtime.GOOS)
+	}
+	path := filepath.Join(t.TempDir(), "locked.txt")
+	newReplacer := func(mode LockMode) *Replacer {
+		writeTestFile(t, path, "old")
+		replacer := newTestReplacer(t, path, "old", "new")
+		replacer.Config.Lock = mode
+		replacer.Config.LockTimeout = 50 * time.Millisecond
+		return replacer
+	}
+	// Another exclusive lock makes the replacement time out, and it goes through once released
+	replacer := newReplacer(LockExclusive)
+	held, err := openLock(context.Background(), path, LockExclusive, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal(fmt.Errorf("expected a timeout, got %v", err))
+	}
+	expectTestFile(t, path, "old")
+	held.release()
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectTestFile(t, path, "new")
+	_ = replacer.Close()
+	// Shared locks do not keep each other out
+	replacer = newReplacer(LockShared)
+	held, err = openLock(context.Background(), path, LockShared, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	held.release()
+	expectTestFile(t, path, "new")
+	_ = replacer.Close()
+	// A file modified while it is replaced is left alone
+	for _, mode := range []LockMode{LockNone, LockExclusive} {
+		replacer = newReplacer(mode)
+		release, err := replacer.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		writeTestFile(t, path, "old and appended")
+		if _, err := replacer.ReplaceSimultaneous(); !errors.Is(err, ErrModified) {
+			t.Fatal(fmt.Errorf("expected ErrModified with %s lock, got %v", mode.String(), err))
+		}
+		release()
+		_ = replacer.Close()
+		expectTestFile(t, path, "old and appended")
+	}
+	// The same goes for a file modified between being staged and committed
+	replacer = newReplacer(LockNone)
+	tx := NewTransaction(filepath.Join(filepath.Dir(path), "gosed.journal"))
+	if _, err := tx.Stage(replacer); err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = replacer.Close()
+	writeTestFile(t, path, "old and appended")
+	if err := tx.Commit(); !errors.Is(err, ErrModified) {
+		t.Fatal(fmt.Errorf("expected ErrModified, got %v", err))
+	}
+	expectTestFile(t, path, "old and appended")
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 1 {
+		t.Fatal(fmt.Errorf("expected the staged file to be removed, found %d files", len(entries)))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	// Every format is written with settings its codec has to keep, and read back by a reader of its own
+	formats := []struct {
+		compression Compression
+		name        string
+		compress    func(w io.Writer) (io.WriteCloser, error)
+		decompress  func(r io.Reader) (io.Reader, error)
+		kept        func(data []byte) bool
+	}{
+		{
+			compression: CompressionGzip,
+			name:        "app.log.gz",
+			compress: func(w io.Writer) (io.WriteCloser, error) {
+				zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+				if err == nil {
+					zw.Name = "app.log"
+				}
+				return zw, err
+			},
+			decompress: func(r io.Reader) (io.Reader, error) {
+				zr, err := gzip.NewReader(r)
+				if err == nil && zr.Name != "app.log" {
+					return nil, fmt.Errorf("expected the name app.log to be kept, got %q", zr.Name)
+				}
+				return zr, err
+			},
+			kept: func(data []byte) bool {
+				return len(data) >= 10 && data[8] == 2
+			},
+		},
+		{
+			compression: CompressionZstd,
+			name:        "app.log.zst",
+			compress: func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+			},
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+			kept: func([]byte) bool {
+				return true
+			},
+		},
+		{
+			compression: CompressionBzip2,
+			name:        "app.log.bz2",
+			compress: func(w io.Writer) (io.WriteCloser, error) {
+				return newBzip2Writer(w, 6)
+			},
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return bzip2.NewReader(r), nil
+			},
+			kept: func(data []byte) bool {
+				return len(data) >= 4 && data[3] == '6'
+			},
+		},
+		{
+			compression: CompressionXz,
+			name:        "app.log.xz",
+			compress: func(w io.Writer) (io.WriteCloser, error) {
+				return xz.WriterConfig{CheckSum: xz.SHA256}.NewWriter(w)
+			},
+			decompress: func(r io.Reader) (io.Reader, error) {
+				return xz.NewReader(r)
+			},
+			kept: func(data []byte) bool {
+				return len(data) >= 8 && data[7] == xz.SHA256
+			},
+		},
+	}
+	modes := map[string]func(*Replacer) (*ReplaceReport, error){
+		"sequential":   (*Replacer).Replace,
+		"chained":      (*Replacer).ReplaceChained,
+		"simultaneous": (*Replacer).ReplaceSimultaneous,
+		"in place": func(rp *Replacer) (*ReplaceReport, error) {
+			// Compressed files are never rewritten in place, Config.InPlace falls back to a temporary file
+			rp.Config.InPlace = true
+			return rp.ReplaceChained()
+		},
+	}
+	for _, format := range formats {
+		path := filepath.Join(dir, format.name)
+		write := func(content string) {
+			var buf bytes.Buffer
+			zw, err := format.compress(&buf)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if _, err := io.WriteString(zw, content); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err.Error())
+			}
+			writeTestFile(t, path, buf.String())
+		}
+		expect := func(content string) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !format.kept(data) {
+				t.Fatal(fmt.Errorf("%s: expected the settings of the original to be kept, got header %v", format.name, data[:8]))
+			}
+			zr, err := format.decompress(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(fmt.Errorf("%s: %s", format.name, err.Error()))
+			}
+			got, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatal(fmt.Errorf("%s: %s", format.name, err.Error()))
+			}
+			if string(got) != content {
+				t.Fatal(fmt.Errorf("%s: expected %q, got %q", format.name, content, got))
+			}
+		}
+		for name, replace := range modes {
+			for _, compression := range []Compression{CompressionAuto, format.compression} {
+				write("old line\nold line\nlast line\n")
+				replacer := newTestReplacer(t, path, "old", "new", "new line", "newer line")
+				replacer.Config.Compression = compression
+				report, err := replace(replacer)
+				if err != nil {
+					t.Fatal(fmt.Errorf("%s %s: %s", format.name, name, err.Error()))
+				}
+				_ = replacer.Close()
+				expected := "newer line\nnewer line\nlast line\n"
+				if name == "simultaneous" {
+					// Simultaneous mappings do not see each other's output
+					expected = "new line\nnew line\nlast line\n"
+				}
+				if report.Compression != format.compression || report.TotalMatches() == 0 {
+					t.Fatal(fmt.Errorf("%s %s: expected matches in a %s file, got %v in %s", format.name, name, format.compression.String(), report.Matches, report.Compression.String()))
+				}
+				expect(expected)
+			}
+		}
+		// A dry run diffs the decompressed contents
+		write("new line\n")
+		var diff bytes.Buffer
+		replacer := newTestReplacer(t, path, "new", "old")
+		replacer.Config.Compression = CompressionAuto
+		replacer.Config.DryRun = true
+		replacer.Config.DiffOutput = &diff
+		if _, err := replacer.ReplaceChained(); err != nil {
+			t.Fatal(fmt.Errorf("%s: %s", format.name, err.Error()))
+		}
+		if !strings.Contains(diff.String(), "-new line\n+old line\n") {
+			t.Fatal(fmt.Errorf("%s: expected a diff of the decompressed content, got %q", format.name, diff.String()))
+		}
+		// Replacing in place or in parallel is refused
+		replacer.Config.DryRun = false
+		if _, err := replacer.ReplaceInPlace(); err == nil {
+			t.Fatal(fmt.Errorf("%s: expected compressed files not to be replaced in place", format.name))
+		}
+		if _, err := replacer.ReplaceParallel(2); err == nil {
+			t.Fatal(fmt.Errorf("%s: expected compressed files not to be replaced in parallel", format.name))
+		}
+		_ = replacer.Close()
+		expect("new line\n")
+	}
+	// Nothing is left behind but the compressed files
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != len(formats) {
+		t.Fatal(fmt.Errorf("expected %d files, found %d", len(formats), len(entries)))
+	}
+	// "old line\nold line\nlast line\n" compressed by bzip2 -6
+	bz2 := []byte{
+		0x42, 0x5a, 0x68, 0x36, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x45, 0xaa, 0xe2, 0x2f, 0x00, 0x00,
+		0x0c, 0xd1, 0x80, 0x00, 0x10, 0x40, 0x00, 0x26, 0x25, 0x8c, 0x00, 0x20, 0x00, 0x21, 0xb5, 0x46,
+		0x4c, 0x9e, 0x82, 0x01, 0xa6, 0x9a, 0x24, 0x95, 0x96, 0x7c, 0xe1, 0xe6, 0xac, 0x64, 0x27, 0x9a,
+		0x2e, 0xe4, 0x8a, 0x70, 0xa1, 0x20, 0x8b, 0x55, 0xc4, 0x5e,
+	}
+	detections := []struct {
+		header   []byte
+		expected Compression
+	}{
+		{bz2, CompressionBzip2},
+		{[]byte{'B', 'Z', 'h', '9', 0x17, 0x72, 0x45, 0x38, 0x50, 0x90, 0, 0, 0, 0}, CompressionBzip2},
+		{[]byte("BZh"), CompressionNone},
+		{[]byte("BZh9 is not a bzip2 stream\n"), CompressionNone},
+		{[]byte{'B', 'Z', 'h', '0', 0x31, 0x41, 0x59, 0x26, 0x53, 0x59}, CompressionNone},
+		{[]byte{0x1f, 0x8b, 8, 0}, CompressionGzip},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, CompressionZstd},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}, CompressionXz},
+		{[]byte("plain text\n"), CompressionNone},
+	}
+	for _, d := range detections {
+		if got := DetectCompression(d.header); got != d.expected {
+			t.Fatal(fmt.Errorf("expected %q to be detected as %s, got %s", d.header, d.expected.String(), got.String()))
+		}
+	}
+	// A text file that merely starts with "BZh" is replaced as it is
+	path := filepath.Join(dir, "notes.txt")
+	writeTestFile(t, path, "BZh old line\n")
+	replacer := newTestReplacer(t, path, "old", "new")
+	replacer.Config.Compression = CompressionAuto
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = replacer.Close()
+	expectTestFile(t, path, "BZh new line\n")
+	// The block size of a file written by bzip2 itself is kept
+	path = filepath.Join(dir, "app.log.bz2")
+	writeTestFile(t, path, string(bz2))
+	replacer = newTestReplacer(t, path, "old", "new")
+	replacer.Config.Compression = CompressionAuto
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = replacer.Close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	if err != nil || string(got) != "new line\nnew line\nlast line\n" || data[3] != '6' {
+		t.Fatal(fmt.Errorf("expected the bzip2 -6 file to be rewritten at level 6, got %q at %c (%v)", got, data[3], err))
+	}
+	// The bzip2 writer round trips empty content, runs, binary data and several blocks
+	random := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("abcd"), 70000),
+		random[:1000],
+		random,
+		append(bytes.Repeat([]byte{0}, 100), bytes.Repeat([]byte("banana\n"), 5000)...),
+	}
+	for i, input := range inputs {
+		var buf bytes.Buffer
+		zw, err := newBzip2Writer(&buf, 1)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// Written in pieces, runs continue across writes
+		for len(input) > 0 {
+			n := len(input)
+			if n > 777 {
+				n = 777
+			}
+			if _, err := zw.Write(input[:n]); err != nil {
+				t.Fatal(err.Error())
+			}
+			input = input[n:]
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if DetectCompression(buf.Bytes()) != CompressionBzip2 {
+			t.Fatal(fmt.Errorf("input %d: expected the output to be detected as bzip2", i))
+		}
+		got, err := ioutil.ReadAll(bzip2.NewReader(&buf))
+		if err != nil {
+			t.Fatal(fmt.Errorf("input %d: %s", i, err.Error()))
+		}
+		if !bytes.Equal(got, inputs[i]) {
+			t.Fatal(fmt.Errorf("input %d: expected %d bytes back, got %d", i, len(inputs[i]), len(got)))
+		}
+	}
+}
+
+// writeTestFile writes content to the file at path
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// expectTestFile fails the test unless the file at path holds content
+func expectTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != content {
+		t.Fatal(fmt.Errorf("expected %q in %s, got %q", content, path, got))
+	}
+}
+
+// newTestReplacer returns a Replacer of the file at path with the string mappings given as pairs of old and new
+func newTestReplacer(t *testing.T, path string, mappings ...string) *Replacer {
+	t.Helper()
+	replacer, err := NewReplacer(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i+1 < len(mappings); i += 2 {
+		if err := replacer.NewStringMapping(mappings[i], mappings[i+1]); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return replacer
+}
+
+func Cleanup() {
+	files, err := filepath.Glob("*.txt")
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, fi := range files {
+		_ = os.Remove(fi)
+	}
+	files, err = filepath.Glob("*.sh")
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, fi := range files {
+		_ = os.Remove(fi)
+	}
+}
+
+func copyFileContents(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	if _, err = io.Copy(out, in); err != nil {
+		return
+	}
+	err = out.Sync()
+	return
+}
@@ -0,0 +1,181 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globPattern is a compiled gitignore-style glob
+type globPattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	base    string // slash separated directory the pattern is relative to, "" for the root
+}
+
+// compileGlob compiles a gitignore-style glob relative to base. Patterns without a slash match the name of a
+// file or directory at any depth, `**` matches across directories and a trailing slash only matches directories.
+func compileGlob(pattern, base string) (*globPattern, error) {
+	glob := &globPattern{base: base}
+	switch {
+	case strings.HasPrefix(pattern, "!"):
+		glob.negate = true
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, `\`):
+		pattern = pattern[1:]
+	}
+	switch {
+	case strings.HasSuffix(pattern, "/"):
+		glob.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+		pattern = pattern[1:]
+	case !strings.Contains(pattern, "/"):
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			switch {
+			case end < 0:
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			switch {
+			case strings.HasPrefix(class, "!"):
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	glob.re = re
+	return glob, nil
+}
+
+// match reports whether the slash separated path rel (relative to the root) matches the pattern
+func (glob *globPattern) match(rel string, isDir bool) bool {
+	switch {
+	case glob.dirOnly && !isDir:
+		return false
+	case glob.base == "":
+		return glob.re.MatchString(rel)
+	case !strings.HasPrefix(rel, glob.base+"/"):
+		return false
+	}
+	return glob.re.MatchString(rel[len(glob.base)+1:])
+}
+
+// ignoreList is an ordered list of gitignore-style rules, where the last matching rule wins
+type ignoreList []*globPattern
+
+// ignored reports whether the slash separated path rel is ignored
+func (list ignoreList) ignored(rel string, isDir bool) bool {
+	var ignored bool
+	for _, rule := range list {
+		switch {
+		case rule.match(rel, isDir):
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchAny reports whether any of the patterns matches the slash separated path rel
+func (list ignoreList) matchAny(rel string, isDir bool) bool {
+	for _, rule := range list {
+		switch {
+		case rule.match(rel, isDir):
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlobs compiles every pattern relative to the root
+func compileGlobs(patterns []string) (ignoreList, error) {
+	list := make(ignoreList, 0, len(patterns))
+	for _, pattern := range patterns {
+		glob, err := compileGlob(pattern, "")
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		list = append(list, glob)
+	}
+	return list, nil
+}
+
+// readIgnoreFile parses the gitignore-style file at file, whose rules apply below the slash separated directory base.
+// A missing file is not an error.
+func readIgnoreFile(file, base string) (ignoreList, error) {
+	fi, err := os.Open(file)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer func(fi *os.File) {
+		_ = fi.Close()
+	}(fi)
+	list := make(ignoreList, 0)
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+		glob, err := compileGlob(line, path.Clean(base))
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		switch glob.base {
+		case ".":
+			glob.base = ""
+		}
+		list = append(list, glob)
+	}
+	return list, scanner.Err()
+}
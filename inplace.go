@@ -0,0 +1,189 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ReplaceInPlace does the replace operation directly on the file, see DoInPlaceReplace.
+func (rp *Replacer) ReplaceInPlace() (*ReplaceReport, error) {
+	return rp.ReplaceInPlaceContext(context.Background())
+}
+
+// ReplaceInPlaceContext is like ReplaceInPlace, but gives up as soon as ctx is done.
+// Matches before the point of cancellation stay replaced, see DoInPlaceReplaceContext.
+func (rp *Replacer) ReplaceInPlaceContext(ctx context.Context) (*ReplaceReport, error) {
+	rp.Config.Semaphore.GCM.Wait()
+	return DoInPlaceReplaceContext(ctx, rp)
+}
+
+// DoInPlaceReplace rewrites the file itself instead of writing a temporary file, so it needs no extra
+// disk space. Every mapping has to replace its key with a value that is at most as long, and regular expression
+// mappings are not supported. Same-length matches are overwritten directly, shorter ones compact the rest of
+// the file towards its start, which is truncated to the new size at the end. The mappings are applied like
+// ReplaceChained does, or like ReplaceSimultaneous does if Transformer.Simultaneous is set.
+// Unlike the other modes the replacement is not atomic, a crash halfway through leaves the file partially replaced.
+func DoInPlaceReplace(rp *Replacer) (*ReplaceReport, error) {
+	return DoInPlaceReplaceContext(context.Background(), rp)
+}
+
+// DoInPlaceReplaceContext is like DoInPlaceReplace, but checks ctx between buffer copies if every replacement is as
+// long as its key. Shrinking replacements always run to the end once started, as stopping halfway would corrupt the file.
+func DoInPlaceReplaceContext(ctx context.Context, rp *Replacer) (*ReplaceReport, error) {
+	defer rp.Config.Semaphore.GCM.Done()
+	return doInPlaceReplace(ctx, rp, rp.Config.Transformer.pipeline)
+}
+
+// doInPlaceReplace copies the file through the reader returned by wrap back onto itself
+func doInPlaceReplace(ctx context.Context, rp *Replacer, wrap func(io.Reader) (*pipeline, error)) (*ReplaceReport, error) {
+	report := &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}
+	start := time.Now()
+	shrinking, err := rp.Config.Transformer.inPlace()
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	release, err := rp.acquire(ctx)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	defer release()
+	switch compressed, err := rp.compressed(); {
+	case err != nil:
+		return report, err
+	case compressed:
+		return report, fmt.Errorf("compressed files cannot be replaced in place")
+	}
+	// The file is opened anew rather than written through Config.File, which refers to the replaced original once
+	// the file has been renamed over by another operation (or another program)
+	file, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, 0)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	// Reading moves the offset of the file while writing does not, so both go through the same descriptor
+	counter := &countingReader{r: file}
+	replacer, err := wrap(bufio.NewReaderSize(counter, 8192))
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	switch rp.Config.DryRun {
+	case true:
+		report.BytesWritten, err = rp.dryRun(ctx, replacer, nil)
+		report.BytesRead = counter.read
+		report.Matches = replacer.matches()
+		report.Duration = time.Since(start)
+		return report, err
+	}
+	// The file is about to be overwritten, so a backup cannot share its inode
+	report.BackupPath, err = rp.backup(false)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	switch shrinking {
+	case true:
+		switch err := ctx.Err(); err {
+		case nil:
+			break
+		default:
+			return report, err
+		}
+		ctx = context.Background()
+	}
+	// The replacing readers never emit a byte before reading it, so writing at the same or a lower offset
+	// only ever overwrites input that has already been read
+	output := &inPlaceWriter{file: file, original: make([]byte, 8192)}
+	wrote, err := copyContext(ctx, output, replacer, make([]byte, 8192))
+	report.BytesRead = counter.read
+	report.BytesWritten = wrote
+	report.Matches = replacer.matches()
+	switch {
+	case err == nil && wrote < report.BytesRead:
+		err = file.Truncate(wrote)
+	}
+	switch err {
+	case nil:
+		err = file.Sync()
+	}
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	rp.Config.FileSize = wrote
+	rp.Config.Transformer.Reset()
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// inPlaceWriter writes to a file at increasing offsets, skipping bytes that are already there
+type inPlaceWriter struct {
+	file     *os.File
+	offset   int64
+	original []byte
+}
+
+// Write implements the `io.Writer` interface.
+func (w *inPlaceWriter) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		chunk := p[written:]
+		switch {
+		case len(chunk) > len(w.original):
+			chunk = chunk[:len(w.original)]
+		}
+		n, err := w.file.ReadAt(w.original[:len(chunk)], w.offset)
+		switch {
+		case err == io.EOF:
+			break
+		case err != nil:
+			return written, err
+		}
+		// Only the runs that differ from the original are written
+		for i := 0; i < len(chunk); {
+			switch {
+			case i < n && chunk[i] == w.original[i]:
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(chunk) && (j >= n || chunk[j] != w.original[j]) {
+				j++
+			}
+			switch _, err := w.file.WriteAt(chunk[i:j], w.offset+int64(i)); err {
+			case nil:
+				break
+			default:
+				return written + i, err
+			}
+			i = j
+		}
+		written += len(chunk)
+		w.offset += int64(len(chunk))
+	}
+	return written, nil
+}
@@ -1,11 +1,13 @@
-package main
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
 
 import (
 	"bytes"
 	"io"
 )
 
-
 // BytesReplacingReader allows transparent replacement of a given token during read operation.
 type BytesReplacingReader struct {
 	r          io.Reader
@@ -18,6 +20,7 @@ type BytesReplacingReader struct {
 	buf        *bytes.Buffer
 	buf0, buf1 int // buf[0:buf0]: bytes already processed; buf[buf0:buf1] bytes read in but not yet processed.
 	max        int // because we need to replace 'search' with 'replace', this marks the max bytes we can read into buf
+	matches    int // number of times 'search' has been replaced so far
 }
 
 const defaultBufSize = int(8192 * 2)
@@ -60,6 +63,7 @@ func (r *BytesReplacingReader) Reset(r1 io.Reader, search1, replace1 []byte) *By
 	}
 	r.buf0 = 0
 	r.buf1 = 0
+	r.matches = 0
 	r.max = len(r.buf.Bytes())
 	switch r.searchLen < r.replaceLen {
 	case true:
@@ -107,13 +111,22 @@ func (r *BytesReplacingReader) Read(p []byte) (int, error) {
 				copy(r.buf.Bytes()[index:index+r.replaceLen], r.replace)
 				r.buf0 = index + r.replaceLen
 				r.buf1 += r.lenDelta
+				r.matches++
 			}
+		}
+		switch {
 		case r.err != nil:
+			// Nothing else can match, including the tail kept back for matches straddling two reads
 			r.buf0 = r.buf1
 		}
 	}
 }
 
+// Matches returns the number of times the search token has been replaced so far.
+func (r *BytesReplacingReader) Matches() int {
+	return r.matches
+}
+
 // Index returns the index of the first instance of sep in s, or -1 if sep is not present in s.
 func Index(s, sep []byte) int {
 	n := len(sep)
@@ -183,7 +196,7 @@ func Index(s, sep []byte) int {
 			o := bytes.IndexByte(s[i+1:t], c0)
 			switch {
 			case o < 0:
-				break
+				return -1
 			}
 			i += o + 1
 		}
@@ -215,7 +228,7 @@ func Index(s, sep []byte) int {
 }
 
 func CutOver(n int) int {
-	return (n+16)/8
+	return (n + 16) / 8
 }
 
 const PrimeRK = 16777619
@@ -263,5 +276,3 @@ func HashStrBytes(sep []byte) (uint32, uint32) {
 	}
 	return hash, pow
 }
-
-
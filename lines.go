@@ -0,0 +1,167 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// lineReplacer replaces the matches within a single line
+type lineReplacer interface {
+	matchCounter
+	replaceLine(line []byte) []byte
+}
+
+// lineEditor writes every line of the input to out, edited or not depending on whether it is selected.
+// end is set on the last line of a selected range, and on every selected line of a single address.
+type lineEditor interface {
+	matchCounter
+	editLine(out *bytes.Buffer, line, terminator []byte, selected, end bool)
+}
+
+// replacingEditor replaces the matches within the selected lines
+type replacingEditor struct {
+	lineReplacer
+}
+
+// editLine implements lineEditor
+func (e replacingEditor) editLine(out *bytes.Buffer, line, terminator []byte, selected, _ bool) {
+	switch selected {
+	case true:
+		out.Write(e.replaceLine(line))
+	default:
+		out.Write(line)
+	}
+	out.Write(terminator)
+}
+
+// lineScanner reads the input one line at a time, with one line of lookahead to recognise the last one
+type lineScanner struct {
+	r      *bufio.Reader
+	primed bool
+	next   []byte // the line following the one returned last, nil at the end of the input
+	number int
+	err    error
+}
+
+// newLineScanner returns a scanner reading the lines of r
+func newLineScanner(r io.Reader) *lineScanner {
+	return &lineScanner{r: bufio.NewReaderSize(r, defaultBufSize)}
+}
+
+// scan returns the next line including its terminator, or false at the end of the input
+func (s *lineScanner) scan() ([]byte, bool) {
+	switch s.primed {
+	case false:
+		s.next, s.err = s.readLine()
+		s.primed = true
+	}
+	line := s.next
+	s.next = nil
+	switch {
+	case line == nil:
+		return nil, false
+	case s.err == nil:
+		s.next, s.err = s.readLine()
+	}
+	s.number++
+	return line, true
+}
+
+// last reports whether the line returned last is the last line of the input
+func (s *lineScanner) last() bool {
+	return s.next == nil
+}
+
+// readLine reads the next line including its terminator, or returns nil at the end of the input
+func (s *lineScanner) readLine() ([]byte, error) {
+	line, err := s.r.ReadBytes('\n')
+	switch len(line) {
+	case 0:
+		return nil, err
+	}
+	return line, err
+}
+
+// lineReplacingReader applies a lineEditor to the lines selected by an Address. The input is read one line
+// at a time (plus one line of lookahead to recognise the last one), so matches never span lines.
+type lineReplacingReader struct {
+	lines   *lineScanner
+	address *Address
+	editor  lineEditor
+	done    bool
+	out     bytes.Buffer
+}
+
+// newLineReplacingReader returns a reader applying editor to the lines of r selected by address
+func newLineReplacingReader(r io.Reader, address *Address, editor lineEditor) *lineReplacingReader {
+	return &lineReplacingReader{
+		lines:   newLineScanner(r),
+		address: address,
+		editor:  editor,
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *lineReplacingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		switch r.done {
+		case true:
+			return 0, r.lines.err
+		}
+		r.advance()
+	}
+	return r.out.Read(p)
+}
+
+// advance processes the next line into r.out
+func (r *lineReplacingReader) advance() {
+	line, ok := r.lines.scan()
+	switch ok {
+	case false:
+		r.done = true
+		return
+	}
+	content, terminator := splitTerminator(line)
+	selected := true
+	switch r.address {
+	case nil:
+		break
+	default:
+		selected = r.address.match(content, r.lines.number, r.lines.last())
+	}
+	r.editor.editLine(&r.out, content, terminator, selected, selected && r.address.closed())
+}
+
+// Matches returns the number of matches replaced so far.
+func (r *lineReplacingReader) Matches() int {
+	return r.editor.Matches()
+}
+
+// splitTerminator splits the trailing newline off a line
+func splitTerminator(line []byte) ([]byte, []byte) {
+	switch {
+	case len(line) > 0 && line[len(line)-1] == '\n':
+		return line[:len(line)-1], line[len(line)-1:]
+	}
+	return line, nil
+}
+
+// replaceLine replaces the matches in a single complete line, the returned slice is only valid until the next call
+func (r *MappingReplacingReader) replaceLine(line []byte) []byte {
+	r.in, r.err, r.prev, r.seen = line, io.EOF, -1, 0
+	r.out.Reset()
+	r.process()
+	return r.out.Bytes()
+}
+
+// replaceLine replaces the matches in a single complete line, the returned slice is only valid until the next call
+func (r *RegexReplacingReader) replaceLine(line []byte) []byte {
+	r.in, r.err, r.abutting, r.started = line, io.EOF, false, false
+	r.out.Reset()
+	r.process()
+	return r.out.Bytes()
+}
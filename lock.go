@@ -0,0 +1,182 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LockMode selects the advisory lock that is held on the file while it is replaced
+type LockMode int
+
+const (
+	// LockNone takes no lock, which is the default
+	LockNone LockMode = iota
+	// LockShared takes a shared lock, which only keeps out processes asking for an exclusive lock
+	LockShared
+	// LockExclusive takes an exclusive lock, which keeps out every other process asking for a lock
+	LockExclusive
+)
+
+// ErrModified is returned (wrapped with the path of the file) when the file is modified by someone else while it
+// is being replaced. The rewritten content is discarded instead of overwriting their changes.
+var ErrModified = errors.New("the file was modified during the replace operation")
+
+// lockPollInterval is the longest time between two attempts to take a lock that is held by another process
+const lockPollInterval = 100 * time.Millisecond
+
+// String returns the name of the lock mode
+func (m LockMode) String() string {
+	switch m {
+	case LockNone:
+		return "none"
+	case LockShared:
+		return "shared"
+	case LockExclusive:
+		return "exclusive"
+	}
+	return fmt.Sprintf("LockMode(%d)", int(m))
+}
+
+// fileLock is held on the file for the duration of a single replace operation. It remembers the state of the file
+// when it was taken, so that the operation can tell whether the file was modified before it is replaced.
+type fileLock struct {
+	// file holds the advisory lock, it is nil for LockNone
+	file *os.File
+	info os.FileInfo
+}
+
+// acquire takes the lock configured by Config.Lock and records the state of the file for Config.DetectChanges.
+// The returned function releases the lock. Calling acquire again while the lock is held returns a no-op, so
+// operations built on top of each other only lock once.
+func (rp *Replacer) acquire(ctx context.Context) (func(), error) {
+	switch {
+	case rp.Config.lock != nil:
+		return func() {}, nil
+	case rp.Config.Lock == LockNone && !rp.Config.DetectChanges:
+		return func() {}, nil
+	}
+	lock, err := openLock(ctx, rp.Config.FilePath, rp.Config.Lock, rp.Config.LockTimeout)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	rp.Config.lock = lock
+	return func() {
+		switch rp.Config.lock {
+		case nil:
+			// The lock was handed over to a Transaction, which releases it once committed or rolled back
+			return
+		}
+		rp.Config.lock.release()
+		rp.Config.lock = nil
+	}, nil
+}
+
+// openLock locks the file at path according to mode, giving up after timeout (if not zero) or when ctx is done.
+// If the file is renamed over while waiting for the lock, which is how every operation but ReplaceInPlace replaces
+// it, the lock is taken again on the new file.
+func openLock(ctx context.Context, path string, mode LockMode, timeout time.Duration) (*fileLock, error) {
+	switch mode {
+	case LockNone:
+		info, err := os.Stat(path)
+		switch err {
+		case nil:
+			return &fileLock{info: info}, nil
+		default:
+			return nil, err
+		}
+	case LockShared, LockExclusive:
+		break
+	default:
+		return nil, fmt.Errorf("invalid lock mode %s", mode.String())
+	}
+	switch {
+	case timeout > 0:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for {
+		file, err := os.Open(path)
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		switch err := lockFile(ctx, file, mode == LockExclusive); {
+		case err == context.DeadlineExceeded && timeout > 0:
+			_ = file.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for the %s lock on %s", timeout.String(), mode.String(), path)
+		case err != nil:
+			_ = file.Close()
+			return nil, err
+		}
+		locked, err := file.Stat()
+		switch err {
+		case nil:
+			break
+		default:
+			_ = file.Close()
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		switch err {
+		case nil:
+			break
+		default:
+			_ = file.Close()
+			return nil, err
+		}
+		switch os.SameFile(locked, info) {
+		case true:
+			return &fileLock{file: file, info: info}, nil
+		}
+		_ = file.Close()
+	}
+}
+
+// release unlocks and closes the locked file
+func (l *fileLock) release() {
+	switch l.file {
+	case nil:
+		return
+	}
+	_ = unlockFile(l.file)
+	_ = l.file.Close()
+}
+
+// modified returns an error wrapping ErrModified if the file at path is not the one the lock was taken on, or if
+// its size or modification time changed since
+func (l *fileLock) modified(path string) error {
+	info, err := os.Stat(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch {
+	case !os.SameFile(l.info, info) || l.info.Size() != info.Size() || !l.info.ModTime().Equal(info.ModTime()):
+		return fmt.Errorf("%s: %w", path, ErrModified)
+	}
+	return nil
+}
+
+// unchanged returns an error if Config.DetectChanges is set and the file was modified since the running operation
+// started
+func (rp *Replacer) unchanged() error {
+	switch {
+	case rp.Config.lock == nil || !rp.Config.DetectChanges:
+		return nil
+	}
+	return rp.Config.lock.modified(rp.Config.FilePath)
+}
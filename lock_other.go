@@ -0,0 +1,23 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package gosed
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// lockFile always fails, as advisory locks are not supported on this platform
+func lockFile(context.Context, *os.File, bool) error {
+	return fmt.Errorf("file locking is not supported on this platform")
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package gosed
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes a flock(2) on file, shared unless exclusive is set. The lock is polled for without blocking, so
+// that waiting for it ends as soon as ctx is done.
+func lockFile(ctx context.Context, file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	switch exclusive {
+	case true:
+		how = syscall.LOCK_EX
+	}
+	delay := time.Millisecond
+	for {
+		switch err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			break
+		default:
+			return &os.PathError{Op: "flock", Path: file.Name(), Err: err}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		switch {
+		case delay < lockPollInterval:
+			delay *= 2
+		}
+	}
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -1,16 +1,15 @@
-// Copyright GoSed (c) 2021, Carter Peel 
+// Copyright GoSed (c) 2021, Carter Peel
 // This code is licensed under MIT license (see LICENSE for details)
 
 package gosed
 
 import (
-	"bufio"
 	"bytes"
-	"fmt"
-	"github.com/carterpeel/go-corelib/ios"
+	"context"
 	"github.com/zenthangplus/goccm"
 	"io"
 	"os"
+	"regexp"
 	"time"
 )
 
@@ -21,22 +20,56 @@ type Replacer struct {
 
 // replacerConfig contains all of the config variables
 type replacerConfig struct {
-	File         *os.File
-	FilePath     string
-	FileSize     int64
-	FilePerm     os.FileMode
-	Asynchronous bool
-	Mappings     *replacerMappings
-	Semaphore    *replacerSemaphore
+	File     *os.File
+	FilePath string
+	FileSize int64
+	FilePerm os.FileMode
+	// PreserveMetadata copies ownership, times and extended attributes of the original file to the rewritten one
+	PreserveMetadata bool
+	// DryRun writes a unified diff of the would-be changes to DiffOutput (os.Stdout if nil) instead of replacing the file
+	DryRun     bool
+	DiffOutput io.Writer
+	// InPlace makes Replace, ReplaceChained and ReplaceSimultaneous rewrite the file in place like ReplaceInPlace
+	// whenever no replacement is longer than its key, which saves the disk space of the temporary file
+	InPlace bool
+	// Engine selects how the file is read by Replace, ReplaceChained and ReplaceSimultaneous
+	Engine Engine
+	// ChunkSize is the number of bytes every worker of ReplaceParallel scans at once, 4 MiB if not set
+	ChunkSize int64
+	// Compression decompresses the file before the mappings are applied and compresses the new content the same
+	// way, see Compression. Compressed files are always replaced in a single pass, and never in place.
+	Compression Compression
+	// Backup keeps the original file when it is replaced, no backup is made if nil
+	Backup *Backup
+	// Lock takes an advisory lock (flock) on the file for the duration of every operation, waiting for at most
+	// LockTimeout (forever if zero). Only processes that lock the file as well are kept out.
+	Lock        LockMode
+	LockTimeout time.Duration
+	// DetectChanges compares the size, modification time and inode of the file before it is replaced with those it
+	// had when the operation started, and fails with ErrModified instead of overwriting the changes of someone else
+	DetectChanges bool
+	// lock is held by the running operation
+	lock *fileLock
+	// transaction is the Transaction staging the replacer, if any
+	transaction *Transaction
+	// Transformer holds the mappings, Mappings is kept as a shortcut to Transformer.Mappings
+	Transformer *Transformer
+	Mappings    *replacerMappings
+	// Semaphore runs the operations of the Replacer one at a time, as they share its config. Many files are
+	// replaced concurrently with a Pool instead.
+	Semaphore *replacerSemaphore
 }
 
 // replacerStringMappings maps old byte sequences to new byte sequences
 type replacerMappings struct {
-	Keys    [][]byte
-	Indices [][]byte
+	Keys     [][]byte
+	Indices  [][]byte
+	Regexps  []*regexp.Regexp  // nil for literal mappings, otherwise Keys holds the pattern and Indices the template
+	Options  []*MappingOptions // nil for plain literal and regular expression mappings
+	Commands []LineCommand     // 0 for mappings, otherwise Keys holds the address and Indices the text of a line command (or the source of a script)
 }
 
-// replacerSemaphore contains all of the channels and waitgroups needed for async
+// replacerSemaphore holds the concurrency manager that lets a single operation of a Replacer run at a time
 type replacerSemaphore struct {
 	GCM goccm.ConcurrencyManager
 }
@@ -57,17 +90,17 @@ func NewReplacer(fileName string) (*Replacer, error) {
 	default:
 		return nil, err
 	}
+	transformer := NewTransformer()
 	return &Replacer{
 		Config: &replacerConfig{
-			File:     fi,
-			FilePath: fileName,
-			FileSize: fd.Size(),
-			FilePerm: fd.Mode().Perm(),
-			Mappings: &replacerMappings{
-				Keys:    make([][]byte, 0),
-				Indices: make([][]byte, 0),
-			},
-			Asynchronous: false,
+			File:             fi,
+			FilePath:         fileName,
+			FileSize:         fd.Size(),
+			FilePerm:         fd.Mode().Perm(),
+			Transformer:      transformer,
+			Mappings:         transformer.Mappings,
+			PreserveMetadata: true,
+			DetectChanges:    true,
 			Semaphore: &replacerSemaphore{
 				GCM: goccm.New(1),
 			},
@@ -77,24 +110,44 @@ func NewReplacer(fileName string) (*Replacer, error) {
 
 // NewMapping maps a new oldString:newString []byte entry
 func (rp *Replacer) NewMapping(oldString, newString []byte) error {
-	switch len(oldString) {
-	case 0:
-		return fmt.Errorf("cannot replace empty string with new value")
-	}
-	rp.Config.Mappings.Keys = append(rp.Config.Mappings.Keys, oldString)
-	rp.Config.Mappings.Indices = append(rp.Config.Mappings.Indices, newString)
-	return nil
+	return rp.Config.Transformer.NewMapping(oldString, newString)
 }
 
 // NewStringMapping maps a new oldString:newString string entry
 func (rp *Replacer) NewStringMapping(oldString, newString string) error {
-	switch oldString {
-	case "":
-		return fmt.Errorf("cannot replace empty string with new value")
-	}
-	rp.Config.Mappings.Keys = append(rp.Config.Mappings.Keys, []byte(oldString))
-	rp.Config.Mappings.Indices = append(rp.Config.Mappings.Indices, []byte(newString))
-	return nil
+	return rp.Config.Transformer.NewStringMapping(oldString, newString)
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that is matched according to options
+func (rp *Replacer) NewMappingWithOptions(oldString, newString []byte, options MappingOptions) error {
+	return rp.Config.Transformer.NewMappingWithOptions(oldString, newString, options)
+}
+
+// NewRegexMappingWithOptions maps a new pattern:template regular expression entry that is scoped to options.Lines
+func (rp *Replacer) NewRegexMappingWithOptions(pattern, template string, options MappingOptions) error {
+	return rp.Config.Transformer.NewRegexMappingWithOptions(pattern, template, options)
+}
+
+// NewLineCommand adds a command that edits the lines selected by a sed-style address
+func (rp *Replacer) NewLineCommand(address string, command LineCommand, text string) error {
+	return rp.Config.Transformer.NewLineCommand(address, command, text)
+}
+
+// NewLineCommandString adds a line command written like in a sed script, such as `/^\[server\]/a port=80`
+func (rp *Replacer) NewLineCommandString(expr string) error {
+	return rp.Config.Transformer.NewLineCommandString(expr)
+}
+
+// NewScript adds a sed script, which runs on the output of the mappings before it
+func (rp *Replacer) NewScript(script *Script) error {
+	return rp.Config.Transformer.NewScript(script)
+}
+
+// NewRegexMapping maps a new pattern:template regular expression entry.
+// The template may reference submatches with `$1` or `${name}`, and a single match can be at most
+// `Config.Transformer.MaxMatchLen` bytes long so the file never has to be buffered as a whole.
+func (rp *Replacer) NewRegexMapping(pattern, template string) error {
+	return rp.Config.Transformer.NewRegexMapping(pattern, template)
 }
 
 func (rp *Replacer) Reset() error {
@@ -119,142 +172,405 @@ func (rp *Replacer) Reset() error {
 	default:
 		return err
 	}
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
+	rp.Config.Transformer.Reset()
 	rp.Config.FilePerm = fd.Mode().Perm()
 	return nil
 }
 
+// Close closes the file opened by NewReplacer
+func (rp *Replacer) Close() error {
+	return rp.Config.File.Close()
+}
+
 // ReplaceChained does the replace operation with a chained reader model
-func (rp *Replacer) ReplaceChained() (int, error) {
+func (rp *Replacer) ReplaceChained() (*ReplaceReport, error) {
+	return rp.ReplaceChainedContext(context.Background())
+}
+
+// ReplaceChainedContext is like ReplaceChained, but gives up as soon as ctx is done.
+// The temporary file is removed on cancellation and the original file is left untouched.
+func (rp *Replacer) ReplaceChainedContext(ctx context.Context) (*ReplaceReport, error) {
 	rp.Config.Semaphore.GCM.Wait()
-	return DoChainReplace(rp)
+	switch rp.inPlace() {
+	case true:
+		defer rp.Config.Semaphore.GCM.Done()
+		return doInPlaceReplace(ctx, rp, rp.Config.Transformer.chain)
+	}
+	return DoChainReplaceContext(ctx, rp)
 }
 
 // Replace does the replace operation with a concurrent (sequential) reader --> tmpfile model
-func (rp *Replacer) Replace() (int, error) {
+func (rp *Replacer) Replace() (*ReplaceReport, error) {
+	return rp.ReplaceContext(context.Background())
+}
+
+// ReplaceContext is like Replace, but gives up as soon as ctx is done.
+// The temporary files are removed on cancellation and the original file is left untouched.
+func (rp *Replacer) ReplaceContext(ctx context.Context) (*ReplaceReport, error) {
+	rp.Config.Semaphore.GCM.Wait()
+	switch rp.inPlace() {
+	case true:
+		defer rp.Config.Semaphore.GCM.Done()
+		return doInPlaceReplace(ctx, rp, rp.Config.Transformer.chain)
+	}
+	return DoSequentialReplaceContext(ctx, rp)
+}
+
+// ReplaceSimultaneous does the replace operation with every mapping matched in a single pass
+func (rp *Replacer) ReplaceSimultaneous() (*ReplaceReport, error) {
+	return rp.ReplaceSimultaneousContext(context.Background())
+}
+
+// ReplaceSimultaneousContext is like ReplaceSimultaneous, but gives up as soon as ctx is done.
+// The temporary file is removed on cancellation and the original file is left untouched.
+func (rp *Replacer) ReplaceSimultaneousContext(ctx context.Context) (*ReplaceReport, error) {
 	rp.Config.Semaphore.GCM.Wait()
-	return DoSequentialReplace(rp)
+	switch rp.inPlace() {
+	case true:
+		defer rp.Config.Semaphore.GCM.Done()
+		return doInPlaceReplace(ctx, rp, rp.Config.Transformer.simultaneous)
+	}
+	return DoSimultaneousReplaceContext(ctx, rp)
+}
+
+// inPlace reports whether Config.InPlace is set and the mappings can be applied in place, which is never the case while
+// staged or for compressed files
+func (rp *Replacer) inPlace() bool {
+	switch {
+	case rp.Config.InPlace && rp.Config.transaction == nil:
+		switch compressed, err := rp.compressed(); {
+		case err != nil || compressed:
+			return false
+		}
+		_, err := rp.Config.Transformer.inPlace()
+		return err == nil
+	}
+	return false
+}
+
+// replace applies the mappings simultaneously if Transformer.Simultaneous is set and chained otherwise
+func (rp *Replacer) replace(ctx context.Context) (*ReplaceReport, error) {
+	switch rp.Config.Transformer.Simultaneous {
+	case true:
+		return rp.ReplaceSimultaneousContext(ctx)
+	default:
+		return rp.ReplaceChainedContext(ctx)
+	}
 }
 
 // DoSequentialReplace does the replace operation without reader chaining, which is slower but less resource intensive.
-func DoSequentialReplace(rp *Replacer) (int, error) {
+func DoSequentialReplace(rp *Replacer) (*ReplaceReport, error) {
+	return DoSequentialReplaceContext(context.Background(), rp)
+}
+
+// DoSequentialReplaceContext is like DoSequentialReplace, but checks ctx between buffer copies.
+// Every pass reads the previous pass' temporary file, so the original is only replaced once all of them succeeded.
+func DoSequentialReplaceContext(ctx context.Context, rp *Replacer) (*ReplaceReport, error) {
 	defer rp.Config.Semaphore.GCM.Done()
+	release, err := rp.acquire(ctx)
+	switch err {
+	case nil:
+		break
+	default:
+		return &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}, err
+	}
+	defer release()
+	compressed, err := rp.compressed()
+	switch err {
+	case nil:
+		break
+	default:
+		return &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}, err
+	}
+	switch {
+	case rp.Config.DryRun || compressed:
+		// Chaining the passes produces the same content without any temporary files, and decompresses the file once
+		return doSinglePassReplace(ctx, rp, rp.Config.Transformer.chain)
+	}
+	report := &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}
+	start := time.Now()
 	buf := bytes.NewBuffer(make([]byte, 8192))
-	replacer := ios.BytesReplacingReader{}
-	DoSingleReplace := func(old, new []byte) (int, error) {
-		tmpFile := fmt.Sprintf("tmp-gosed-%d", time.Now().UnixNano())
-		input, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, rp.Config.FilePerm)
+	replacer := BytesReplacingReader{}
+	source := rp.Config.FilePath
+	DoSingleReplace := func(index int) (*os.File, error) {
+		input, err := rp.openSource(source)
 		switch err {
 		case nil:
 			break
 		default:
-			return 0, err
+			return nil, err
 		}
-		output, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE, rp.Config.FilePerm)
+		defer func(input io.Closer) {
+			_ = input.Close()
+		}(input)
+		output, err := createTemp(rp.Config.FilePath, rp.Config.FilePerm)
 		switch err {
 		case nil:
 			break
 		default:
-			return 0, err
+			return nil, err
 		}
-		defer func(input, output *os.File) {
-			_ = input.Close()
-			_ = input.Close()
-		}(input, output)
-		replacer.Reset(bufio.NewReaderSize(input, 8192), old, new)
-		wrote, err := io.CopyBuffer(output, &replacer, buf.Bytes())
+		reader := rp.Config.Transformer.stage(index, input.plain(), &replacer)
+		wrote, err := copyContext(ctx, output, reader, buf.Bytes())
 		switch err {
 		case nil:
 			break
 		default:
-			return 0, err
+			discardTemp(output)
+			return nil, err
+		}
+		switch index {
+		case 0:
+			report.BytesRead = input.read()
 		}
-		switch err := os.Remove(rp.Config.FilePath); err {
+		report.Matches[index] = reader.Matches()
+		report.BytesWritten = wrote
+		return output, nil
+	}
+	var output *os.File
+	for index := range rp.Config.Mappings.Keys {
+		next, err := DoSingleReplace(index)
+		switch output {
 		case nil:
 			break
 		default:
-			return 0, err
+			// The previous pass' output has been consumed
+			discardTemp(output)
 		}
-		switch err := os.Rename(tmpFile, rp.Config.FilePath); err {
+		switch err {
 		case nil:
 			break
 		default:
-			return 0, err
+			return report, err
 		}
-		rp.Config.FileSize = wrote
-		return int(wrote), nil
+		output = next
+		source = output.Name()
 	}
-	var count int
-	for index, key := range rp.Config.Mappings.Keys {
-		wrote, err := DoSingleReplace(key, rp.Config.Mappings.Indices[index])
-		switch err {
+	switch output {
+	case nil:
+		report.BytesRead = rp.Config.FileSize
+		report.BytesWritten = rp.Config.FileSize
+	default:
+		switch err := rp.commit(output, report); err {
 		case nil:
 			break
 		default:
-			return count, err
+			return report, err
 		}
-		count += wrote
-		rp.Config.FileSize = int64(wrote)
+		report.TempPath = output.Name()
+		rp.Config.FileSize = report.BytesWritten
 	}
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	return count, nil
+	rp.Config.Transformer.Reset()
+	report.Duration = time.Since(start)
+	return report, nil
 
 }
 
 // DoChainReplace does the replace operation with reader chaining, which is faster but more resource intensive.
-func DoChainReplace(rp *Replacer) (int, error) {
-	tmpfile := fmt.Sprintf("tmp-gosed-%d", time.Now().UnixNano())
-	input, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, rp.Config.FilePerm)
+func DoChainReplace(rp *Replacer) (*ReplaceReport, error) {
+	return DoChainReplaceContext(context.Background(), rp)
+}
+
+// DoChainReplaceContext is like DoChainReplace, but checks ctx between buffer copies.
+func DoChainReplaceContext(ctx context.Context, rp *Replacer) (*ReplaceReport, error) {
+	defer rp.Config.Semaphore.GCM.Done()
+	return doSinglePassReplace(ctx, rp, rp.Config.Transformer.chain)
+}
+
+// DoSimultaneousReplace does the replace operation with an Aho-Corasick automaton built from all of the mappings.
+// Unlike the chained and sequential models, the output of one mapping can never be rewritten by another one.
+func DoSimultaneousReplace(rp *Replacer) (*ReplaceReport, error) {
+	return DoSimultaneousReplaceContext(context.Background(), rp)
+}
+
+// DoSimultaneousReplaceContext is like DoSimultaneousReplace, but checks ctx between buffer copies.
+func DoSimultaneousReplaceContext(ctx context.Context, rp *Replacer) (*ReplaceReport, error) {
+	defer rp.Config.Semaphore.GCM.Done()
+	return doSinglePassReplace(ctx, rp, rp.Config.Transformer.simultaneous)
+}
+
+// doSinglePassReplace copies the file through the reader returned by wrap into a temporary file,
+// which then atomically replaces the original. The temporary file is removed if anything goes wrong.
+func doSinglePassReplace(ctx context.Context, rp *Replacer, wrap func(io.Reader) (*pipeline, error)) (*ReplaceReport, error) {
+	report := &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}
+	start := time.Now()
+	release, err := rp.acquire(ctx)
 	switch err {
 	case nil:
 		break
 	default:
-		return 0, err
+		return report, err
 	}
-	output, err := os.OpenFile(tmpfile, os.O_RDWR|os.O_CREATE, rp.Config.FilePerm)
+	defer release()
+	input, err := rp.openSource(rp.Config.FilePath)
 	switch err {
 	case nil:
 		break
 	default:
-		return 0, err
+		return report, err
 	}
-	defer func(input, output *os.File) {
+	defer func(input io.Closer) {
 		_ = input.Close()
-		_ = input.Close()
-		rp.Config.Semaphore.GCM.Done()
-	}(input, output)
-	var replacer = ios.NewBytesReplacingReader(bufio.NewReaderSize(input, 8192), rp.Config.Mappings.Keys[0], rp.Config.Mappings.Indices[0])
-	//replacer.SetBufferSize(8192*4)
-	for index, key := range rp.Config.Mappings.Keys {
-		if index == 0 {
-			continue
+	}(input)
+	compression, codec, err := rp.codec()
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	report.Compression = compression
+	switch err := input.decompress(codec); err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	replacer, err := wrap(input.plain())
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	switch rp.Config.DryRun {
+	case true:
+		report.BytesWritten, err = rp.dryRun(ctx, replacer, codec)
+		report.BytesRead = input.read()
+		report.Matches = replacer.matches()
+		report.Duration = time.Since(start)
+		return report, err
+	}
+	output, err := createTemp(rp.Config.FilePath, rp.Config.FilePerm)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	// The new content is recompressed on its way to the temporary file with the codec it was decompressed with
+	counter := &countingWriter{w: output}
+	var sink io.Writer = counter
+	var compressor io.WriteCloser
+	switch codec {
+	case nil:
+		break
+	default:
+		compressor, err = codec.NewWriter(counter, input.decompressed)
+		switch err {
+		case nil:
+			sink = compressor
+		default:
+			discardTemp(output)
+			return report, err
 		}
-		replacer = ios.NewBytesReplacingReader(replacer, key, rp.Config.Mappings.Indices[index])
 	}
-	wrote, err := io.CopyBuffer(output, replacer, make([]byte, 8192))
+	_, err = copyContext(ctx, sink, replacer, make([]byte, 8192))
+	switch {
+	case err == nil && compressor != nil:
+		err = compressor.Close()
+	}
 	switch err {
 	case nil:
 		break
 	default:
-		return 0, err
+		discardTemp(output)
+		return report, err
 	}
-	switch err := os.Remove(rp.Config.FilePath); err {
+	report.BytesRead = input.read()
+	report.BytesWritten = counter.written
+	report.Matches = replacer.matches()
+	switch err := rp.commit(output, report); err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	report.TempPath = output.Name()
+	rp.Config.FileSize = counter.written
+	rp.Config.Transformer.Reset()
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// dryRun writes a unified diff between the file and the content produced by replacer to Config.DiffOutput.
+// The file is left untouched and the mappings are kept, so the same Replacer can do the real replace afterwards.
+// The file is decompressed with codec unless it is nil, so that the diff is between the decompressed contents.
+func (rp *Replacer) dryRun(ctx context.Context, replacer io.Reader, codec Codec) (int64, error) {
+	file, err := os.Open(rp.Config.FilePath)
+	switch err {
 	case nil:
 		break
 	default:
 		return 0, err
 	}
-	switch err := os.Rename(tmpfile, rp.Config.FilePath); err {
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	original, err := decompress(codec, file)
+	switch err {
 	case nil:
 		break
 	default:
 		return 0, err
 	}
-	rp.Config.FileSize = wrote
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	return int(wrote), nil
+	defer func(original io.Closer) {
+		_ = original.Close()
+	}(original)
+	var output io.Writer = os.Stdout
+	switch {
+	case rp.Config.DiffOutput != nil:
+		output = rp.Config.DiffOutput
+	}
+	wrote, _, err := unifiedDiff(output, rp.Config.FilePath, original, &contextReader{ctx: ctx, r: replacer})
+	return wrote, err
 }
 
+// contextReader is an io.Reader that fails with the context's error once it is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements the `io.Reader` interface.
+func (r *contextReader) Read(p []byte) (int, error) {
+	switch err := r.ctx.Err(); err {
+	case nil:
+		return r.r.Read(p)
+	default:
+		return 0, err
+	}
+}
+
+// copyContext copies from src to dst like io.CopyBuffer, but checks ctx before every buffer copy
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	var written int64
+	for {
+		switch err := ctx.Err(); err {
+		case nil:
+			break
+		default:
+			return written, err
+		}
+		n, err := src.Read(buf)
+		switch {
+		case n > 0:
+			wrote, werr := dst.Write(buf[:n])
+			written += int64(wrote)
+			switch {
+			case werr != nil:
+				return written, werr
+			case wrote != n:
+				return written, io.ErrShortWrite
+			}
+		}
+		switch err {
+		case nil:
+			continue
+		case io.EOF:
+			return written, nil
+		default:
+			return written, err
+		}
+	}
+}
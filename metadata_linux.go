@@ -0,0 +1,182 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build linux
+// +build linux
+
+package gosed
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// preserveMetadata copies ownership, permission bits (including setuid, setgid and sticky),
+// extended attributes and access/modification times from the file at path to tmp.
+// ACLs and SELinux labels are stored as extended attributes and are copied along with them.
+func preserveMetadata(tmp *os.File, path string) error {
+	fi, err := os.Stat(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	tfi, err := tmp.Stat()
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	// Ownership goes first, because changing it clears the setuid and setgid bits
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	tst := tfi.Sys().(*syscall.Stat_t)
+	uidKept, gidKept, err := chownFallback(tmp.Chown, int(tst.Uid), int(tst.Gid), int(st.Uid), int(st.Gid))
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	// A setuid or setgid bit is dropped rather than granted to the user replacing the file
+	switch {
+	case !uidKept:
+		mode &^= os.ModeSetuid
+	}
+	switch {
+	case !gidKept:
+		mode &^= os.ModeSetgid
+	}
+	switch err := tmp.Chmod(mode); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := copyXattrs(path, tmp.Name()); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	return os.Chtimes(tmp.Name(), time.Unix(st.Atim.Sec, st.Atim.Nsec), fi.ModTime())
+}
+
+// chownFallback gives the file the owner uid and group gid through chown, if it does not already have them (which
+// it has if it is owned by tmpUid and tmpGid). Like `sed -i`, a user who may not give away the file (which only root
+// may do) keeps it and just sets the group, and if that is not permitted either the ownership is left as it is.
+// It reports whether the owner and the group are the ones asked for.
+func chownFallback(chown func(uid, gid int) error, tmpUid, tmpGid, uid, gid int) (bool, bool, error) {
+	switch {
+	case tmpUid == uid && tmpGid == gid:
+		return true, true, nil
+	}
+	// The owner may already be the one asked for, with only the group to change
+	uidKept := tmpUid == uid
+	switch err := chown(uid, gid); {
+	case err == nil:
+		return true, true, nil
+	case !isPermission(err):
+		return false, false, err
+	case tmpGid == gid:
+		return uidKept, true, nil
+	}
+	switch err := chown(-1, gid); {
+	case err == nil:
+		return uidKept, true, nil
+	case !isPermission(err):
+		return false, false, err
+	}
+	return uidKept, false, nil
+}
+
+// isPermission reports whether err is EPERM or EACCES
+func isPermission(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
+
+// copyXattrs copies every extended attribute of src to dst. Filesystems without xattr support are ignored, and so
+// are attributes the user may not set, like those in the trusted and security namespaces.
+func copyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	switch err {
+	case nil:
+		break
+	case syscall.ENOTSUP:
+		return nil
+	default:
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		switch err {
+		case nil:
+			break
+		case syscall.ENODATA:
+			// Removed since it was listed
+			continue
+		default:
+			return err
+		}
+		switch err := syscall.Setxattr(dst, name, value, 0); {
+		case err == nil || err == syscall.ENOTSUP || isPermission(err):
+			break
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of all extended attributes of path
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	switch {
+	case err != nil:
+		return nil, err
+	case size == 0:
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		switch len(name) {
+		case 0:
+			continue
+		}
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	switch {
+	case err != nil:
+		return nil, err
+	case size == 0:
+		return []byte{}, nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	return buf[:size], nil
+}
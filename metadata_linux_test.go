@@ -0,0 +1,114 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test-metadata.txt")
+	if err := ioutil.WriteFile(path, []byte("foo bar foo"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Chmod(path, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err.Error())
+	}
+	hasXattrs := true
+	if err := syscall.Setxattr(path, "user.gosed", []byte("label"), 0); err != nil {
+		t.Logf("extended attributes are not supported here: %s", err.Error())
+		hasXattrs = false
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("foo", "baz"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.Mode()&(os.ModePerm|os.ModeSetuid) != 0755|os.ModeSetuid {
+		t.Fatal(fmt.Errorf("mode was not preserved: %v", fi.Mode()))
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatal(fmt.Errorf("modification time was not preserved: %v", fi.ModTime()))
+	}
+	if hasXattrs {
+		value, err := getXattr(path, "user.gosed")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(value, []byte("label")) {
+			t.Fatal(fmt.Errorf("extended attribute was not preserved: %q", value))
+		}
+	}
+
+	replacer.Config.PreserveMetadata = false
+	if err := replacer.NewStringMapping("baz", "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	fi, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fi.ModTime().Equal(mtime) || fi.Mode()&os.ModeSetuid != 0 {
+		t.Fatal(fmt.Errorf("metadata was preserved although it was disabled"))
+	}
+}
+
+func TestChownFallback(t *testing.T) {
+	// chown fails with err for the listed owners, and succeeds for the others
+	fakeChown := func(calls *[][2]int, refused map[[2]int]error) func(uid, gid int) error {
+		return func(uid, gid int) error {
+			*calls = append(*calls, [2]int{uid, gid})
+			return refused[[2]int{uid, gid}]
+		}
+	}
+	// The file is owned by tmpUid and group 0, and is given owner 2 and group 3
+	cases := []struct {
+		name             string
+		tmpUid           int
+		refused          map[[2]int]error
+		uidKept, gidKept bool
+		calls            int
+		err              bool
+	}{
+		{"owner and group", 0, nil, true, true, 1, false},
+		{"group only", 0, map[[2]int]error{{2, 3}: syscall.EPERM}, false, true, 2, false},
+		{"neither", 0, map[[2]int]error{{2, 3}: syscall.EPERM, {-1, 3}: syscall.EPERM}, false, false, 2, false},
+		{"other errors", 0, map[[2]int]error{{2, 3}: syscall.EIO}, false, false, 1, true},
+		{"same owner, group only", 2, map[[2]int]error{{2, 3}: syscall.EPERM}, true, true, 2, false},
+		{"same owner, other group", 2, map[[2]int]error{{2, 3}: syscall.EPERM, {-1, 3}: syscall.EPERM}, true, false, 2, false},
+	}
+	for _, c := range cases {
+		var calls [][2]int
+		uidKept, gidKept, err := chownFallback(fakeChown(&calls, c.refused), c.tmpUid, 0, 2, 3)
+		if (err != nil) != c.err || uidKept != c.uidKept || gidKept != c.gidKept || len(calls) != c.calls {
+			t.Fatal(fmt.Errorf("%s: got owner %v, group %v, error %v after chown calls %v", c.name, uidKept, gidKept, err, calls))
+		}
+	}
+	// Nothing is changed if the owner is already right
+	var calls [][2]int
+	if uidKept, gidKept, err := chownFallback(fakeChown(&calls, nil), 2, 3, 2, 3); err != nil || !uidKept || !gidKept || len(calls) != 0 {
+		t.Fatal(fmt.Errorf("expected no chown calls, got %v", calls))
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build !linux
+// +build !linux
+
+package gosed
+
+import (
+	"os"
+)
+
+// preserveMetadata copies permission bits (including setuid, setgid and sticky) and the modification time
+// from the file at path to tmp. Ownership and extended attributes are only preserved on linux.
+func preserveMetadata(tmp *os.File, path string) error {
+	fi, err := os.Stat(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := tmp.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	return os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,232 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// Engine selects how a Replacer reads the file it searches
+type Engine int
+
+const (
+	// EngineStream copies the file through fixed size buffers, which works for any kind of file
+	EngineStream Engine = iota
+	// EngineMmap maps the file into memory and only copies the spans between matches, which is much faster
+	// when matches are rare. Files that cannot be mapped, like pipes, fall back to EngineStream.
+	// The file must not be truncated by another process while it is mapped.
+	EngineMmap
+)
+
+// source is the input of a replace operation
+type source struct {
+	io.Reader
+	file         *os.File
+	counter      *countingReader // nil if the file is mapped
+	mapped       []byte
+	decompressed io.ReadCloser // nil unless the file is compressed
+}
+
+// openSource opens the file at path for reading with the engine selected in Config.Engine
+func (rp *Replacer) openSource(path string) (*source, error) {
+	fi, err := os.Open(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	src := &source{file: fi}
+	switch rp.Config.Engine {
+	case EngineMmap:
+		data, err := mapFile(fi)
+		switch err {
+		case nil:
+			src.mapped = data
+			src.Reader = &mappedReader{data: data}
+			return src, nil
+		}
+	}
+	src.counter = &countingReader{r: fi}
+	src.Reader = bufio.NewReaderSize(src.counter, 8192)
+	return src, nil
+}
+
+// read returns the number of bytes read from the file so far
+func (src *source) read() int64 {
+	switch src.counter {
+	case nil:
+		return int64(src.Reader.(*mappedReader).pos)
+	default:
+		return src.counter.read
+	}
+}
+
+// decompress makes plain return the content of the file decompressed with codec, unless codec is nil
+func (src *source) decompress(codec Codec) error {
+	switch codec {
+	case nil:
+		return nil
+	}
+	decompressed, err := codec.NewReader(src.Reader)
+	switch err {
+	case nil:
+		src.decompressed = decompressed
+		return nil
+	default:
+		return err
+	}
+}
+
+// plain returns the reader the mappings are applied to. Unless the file is compressed, that is the reader of the
+// engine itself, which the replacing readers of the first stage recognise if the file is mapped.
+func (src *source) plain() io.Reader {
+	switch src.decompressed {
+	case nil:
+		return src.Reader
+	default:
+		return src.decompressed
+	}
+}
+
+// Close unmaps and closes the file
+func (src *source) Close() error {
+	switch src.decompressed {
+	case nil:
+		break
+	default:
+		_ = src.decompressed.Close()
+	}
+	switch src.mapped {
+	case nil:
+		break
+	default:
+		_ = unmapFile(src.mapped)
+	}
+	return src.file.Close()
+}
+
+// mappedReader reads a mapped file. The replacing readers of the first stage recognise it and
+// search the mapped memory directly instead of reading from it.
+type mappedReader struct {
+	data []byte
+	pos  int
+}
+
+// Read implements the `io.Reader` interface.
+func (r *mappedReader) Read(p []byte) (int, error) {
+	switch {
+	case r.pos >= len(r.data):
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// isMapped reports whether r is a mapped file
+func isMapped(r io.Reader) bool {
+	_, ok := r.(*mappedReader)
+	return ok
+}
+
+// mappedReplacingReader replaces matches in a mapped file. It looks up the next match with find
+// and copies everything up to it straight out of the mapped memory.
+type mappedReplacingReader struct {
+	src     *mappedReader
+	find    func(from int) (int, int) // start and key of the first match at or after from, -1 if there is none
+	lengths []int
+	replace [][]byte
+	next    int // start of the next match, len(src.data) if there is none
+	nextKey int
+	pending []byte // remainder of the replacement being copied out
+	matches []int
+}
+
+// newMappedReplacingReader returns a reader replacing the matches reported by find in src
+func newMappedReplacingReader(src *mappedReader, find func(int) (int, int), lengths []int, replace [][]byte) *mappedReplacingReader {
+	r := &mappedReplacingReader{
+		src:     src,
+		find:    find,
+		lengths: lengths,
+		replace: replace,
+		matches: make([]int, len(replace)),
+	}
+	r.seek()
+	return r
+}
+
+// newMappedBytesReplacingReader returns a reader replacing search with replace in src, using Index
+func newMappedBytesReplacingReader(src *mappedReader, search, replace []byte) *mappedReplacingReader {
+	find := func(from int) (int, int) {
+		switch index := Index(src.data[from:], search); {
+		case index < 0:
+			return -1, 0
+		default:
+			return from + index, 0
+		}
+	}
+	return newMappedReplacingReader(src, find, []int{len(search)}, [][]byte{replace})
+}
+
+// newMappedMultiReplacingReader returns a reader replacing every search[i] with replace[i] in src at once,
+// with the same leftmost-longest semantics as MultiBytesReplacingReader
+func newMappedMultiReplacingReader(src *mappedReader, search, replace [][]byte) *mappedReplacingReader {
+	ac := newAhoCorasick(search)
+	find := func(from int) (int, int) {
+		start, key, _ := ac.leftmostLongest(src.data, from, true)
+		return start, key
+	}
+	return newMappedReplacingReader(src, find, ac.lengths, replace)
+}
+
+// seek looks up the next match after the current position
+func (r *mappedReplacingReader) seek() {
+	switch start, key := r.find(r.src.pos); {
+	case start < 0:
+		r.next = len(r.src.data)
+	default:
+		r.next, r.nextKey = start, key
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *mappedReplacingReader) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		switch {
+		case len(r.pending) > 0:
+			copied := copy(p[n:], r.pending)
+			r.pending = r.pending[copied:]
+			n += copied
+		case r.src.pos < r.next:
+			copied := copy(p[n:], r.src.data[r.src.pos:r.next])
+			r.src.pos += copied
+			n += copied
+		case r.next < len(r.src.data):
+			r.pending = r.replace[r.nextKey]
+			r.matches[r.nextKey]++
+			r.src.pos += r.lengths[r.nextKey]
+			r.seek()
+		default:
+			switch n {
+			case 0:
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// Matches returns the number of matches replaced so far across all keys
+func (r *mappedReplacingReader) Matches() int {
+	var total int
+	for _, matches := range r.matches {
+		total += matches
+	}
+	return total
+}
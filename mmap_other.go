@@ -0,0 +1,22 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package gosed
+
+import (
+	"fmt"
+	"os"
+)
+
+// mapFile always fails, so the mmap engine falls back to streaming on this platform
+func mapFile(*os.File) ([]byte, error) {
+	return nil, fmt.Errorf("memory mapped files are not supported on this platform")
+}
+
+// unmapFile releases a mapping created by mapFile
+func unmapFile([]byte) error {
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package gosed
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole of f into memory read-only. Only non-empty regular files can be mapped.
+func mapFile(f *os.File) ([]byte, error) {
+	fd, err := f.Stat()
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	switch size := fd.Size(); {
+	case !fd.Mode().IsRegular():
+		return nil, fmt.Errorf("%s is not a regular file", f.Name())
+	case size == 0:
+		return nil, fmt.Errorf("%s is empty", f.Name())
+	case size != int64(int(size)):
+		return nil, fmt.Errorf("%s is too large to be mapped", f.Name())
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(fd.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a mapping created by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
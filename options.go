@@ -0,0 +1,449 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MappingOptions changes how the key of a literal mapping is matched and replaced
+type MappingOptions struct {
+	// IgnoreCase matches ASCII letters regardless of their case
+	IgnoreCase bool
+	// FoldCase matches using Unicode simple case folding, so `K` also matches the Kelvin sign. It implies IgnoreCase.
+	FoldCase bool
+	// PreserveCase adapts the replacement to the case pattern of every match: an all upper case match gets an
+	// all upper case replacement, an all lower case one a lower case replacement and a capitalised one a capitalised replacement
+	PreserveCase bool
+	// WholeWord only counts a match when it is neither preceded nor followed by a word character
+	WholeWord bool
+	// WordChars are the bytes WholeWord considers word characters, ranges like `a-z` are allowed.
+	// It defaults to ASCII letters, digits, `_` and every non-ASCII byte.
+	WordChars string
+	// Occurrence selects which of the matches are replaced, all of them by default. With Lines set it counts per line.
+	Occurrence Occurrence
+	// Lines restricts the mapping to the lines selected by a sed-style address like `100,200`, `$`,
+	// `/^\[server\]/,/^\[/`, `5,+3` or `0~2`, see Address. Matches never span lines then.
+	Lines string
+}
+
+// OccurrenceMode is the way an Occurrence selects matches
+type OccurrenceMode int
+
+const (
+	// OccurrenceAll replaces every match
+	OccurrenceAll OccurrenceMode = iota
+	// OccurrenceFirst replaces the first N matches
+	OccurrenceFirst
+	// OccurrenceNth replaces only the Nth match, like `s/old/new/N` does in sed
+	OccurrenceNth
+	// OccurrenceEvery replaces every Nth match
+	OccurrenceEvery
+	// OccurrenceFrom replaces the Nth match and every one after it, like `s/old/new/Ng` does in sed
+	OccurrenceFrom
+)
+
+// Occurrence selects matches by their position, counting from 1. Matches that are not selected are left
+// as they are, but still count as matches for the ones following them.
+type Occurrence struct {
+	Mode OccurrenceMode
+	N    int
+}
+
+// valid returns an error if the options are invalid
+func (options MappingOptions) valid() error {
+	switch err := options.Occurrence.valid(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch options.Lines {
+	case "":
+		return nil
+	}
+	_, err := ParseAddress(options.Lines)
+	return err
+}
+
+// valid returns an error if the occurrence cannot select anything
+func (o Occurrence) valid() error {
+	switch {
+	case o.Mode < OccurrenceAll || o.Mode > OccurrenceFrom:
+		return fmt.Errorf("unknown occurrence mode %d", o.Mode)
+	case o.Mode != OccurrenceAll && o.N < 1:
+		return fmt.Errorf("occurrence N must be at least 1, got %d", o.N)
+	}
+	return nil
+}
+
+// selected reports whether the kth match is replaced
+func (o Occurrence) selected(k int) bool {
+	switch o.Mode {
+	case OccurrenceFirst:
+		return k <= o.N
+	case OccurrenceNth:
+		return k == o.N
+	case OccurrenceEvery:
+		return k%o.N == 0
+	case OccurrenceFrom:
+		return k >= o.N
+	default:
+		return true
+	}
+}
+
+// exhausted reports whether no match after the kth one can be selected any more
+func (o Occurrence) exhausted(k int) bool {
+	switch o.Mode {
+	case OccurrenceFirst, OccurrenceNth:
+		return k >= o.N
+	default:
+		return false
+	}
+}
+
+// defaultWordChars are the word characters used by WholeWord unless MappingOptions.WordChars is set
+const defaultWordChars = "A-Za-z0-9_\x80-\xff"
+
+// matchStatus is the outcome of matching a key at a single position
+type matchStatus int
+
+const (
+	matchNone matchStatus = iota
+	matchFound
+	matchNeedMore // the input ends before the match could be decided
+)
+
+// keyMatcher matches a single key at a given position according to its options
+type keyMatcher struct {
+	key     []byte
+	options MappingOptions
+	orbits  [][]rune  // FoldCase only: every rune equivalent to each rune of the key, nil for invalid bytes
+	invalid []byte    // FoldCase only: the invalid byte of the key where orbits is nil
+	first   [256]bool // bytes a match can start with
+	word    [256]bool // WholeWord only: bytes that are part of a word
+	maxLen  int       // longest possible match in bytes
+}
+
+// newKeyMatcher returns a keyMatcher for key
+func newKeyMatcher(key []byte, options MappingOptions) *keyMatcher {
+	m := &keyMatcher{key: key, options: options, maxLen: len(key)}
+	switch {
+	case options.FoldCase:
+		m.maxLen = 0
+		for len(key) > 0 {
+			r, size := utf8.DecodeRune(key)
+			switch {
+			case r == utf8.RuneError && size == 1:
+				// Invalid bytes only ever match themselves
+				m.orbits = append(m.orbits, nil)
+				m.invalid = append(m.invalid, key[0])
+				m.maxLen++
+				key = key[size:]
+				continue
+			}
+			key = key[size:]
+			orbit := foldOrbit(r)
+			longest := 0
+			for _, equivalent := range orbit {
+				longest = max(longest, utf8.RuneLen(equivalent))
+			}
+			m.maxLen += longest
+			m.orbits = append(m.orbits, orbit)
+			m.invalid = append(m.invalid, 0)
+		}
+		var buf [utf8.UTFMax]byte
+		for _, r := range m.orbits[0] {
+			utf8.EncodeRune(buf[:], r)
+			m.first[buf[0]] = true
+		}
+		switch m.orbits[0] {
+		case nil:
+			m.first[m.invalid[0]] = true
+		}
+	case options.IgnoreCase:
+		m.first[asciiLower(m.key[0])] = true
+		m.first[asciiUpper(m.key[0])] = true
+	default:
+		m.first[m.key[0]] = true
+	}
+	switch options.WholeWord {
+	case true:
+		chars := options.WordChars
+		switch chars {
+		case "":
+			chars = defaultWordChars
+		}
+		for i := 0; i < len(chars); i++ {
+			switch {
+			case i+2 < len(chars) && chars[i+1] == '-':
+				for c := int(chars[i]); c <= int(chars[i+2]); c++ {
+					m.word[c] = true
+				}
+				i += 2
+			default:
+				m.word[chars[i]] = true
+			}
+		}
+	}
+	return m
+}
+
+// foldOrbit returns r along with every rune it is equivalent to under Unicode simple case folding
+func foldOrbit(r rune) []rune {
+	orbit := []rune{r}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		orbit = append(orbit, f)
+	}
+	return orbit
+}
+
+// asciiLower returns the lower case of an ASCII letter, and any other byte as it is
+func asciiLower(c byte) byte {
+	switch {
+	case 'A' <= c && c <= 'Z':
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// asciiUpper returns the upper case of an ASCII letter, and any other byte as it is
+func asciiUpper(c byte) byte {
+	switch {
+	case 'a' <= c && c <= 'z':
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+// match matches the key at the start of s and returns the length of the match.
+// Unless `final` is set more input may follow s.
+func (m *keyMatcher) match(s []byte, final bool) (int, matchStatus) {
+	switch {
+	case m.options.FoldCase:
+		var n int
+		for k, orbit := range m.orbits {
+			switch {
+			case n >= len(s) && final:
+				return 0, matchNone
+			case n >= len(s) || (!utf8.FullRune(s[n:]) && !final):
+				return 0, matchNeedMore
+			}
+			r, size := utf8.DecodeRune(s[n:])
+			switch {
+			case orbit == nil:
+				// Invalid bytes in the key have to match exactly
+				switch {
+				case s[n] != m.invalid[k]:
+					return 0, matchNone
+				}
+				size = 1
+			case r == utf8.RuneError && size == 1, !runeIn(r, orbit):
+				return 0, matchNone
+			}
+			n += size
+		}
+		return n, matchFound
+	}
+	for i, c := range m.key {
+		switch {
+		case i >= len(s) && final:
+			return 0, matchNone
+		case i >= len(s):
+			return 0, matchNeedMore
+		case c == s[i]:
+			continue
+		case m.options.IgnoreCase && asciiLower(c) == asciiLower(s[i]):
+			continue
+		}
+		return 0, matchNone
+	}
+	return len(m.key), matchFound
+}
+
+// runeIn reports whether r is one of runes
+func runeIn(r rune, runes []rune) bool {
+	for _, candidate := range runes {
+		switch candidate {
+		case r:
+			return true
+		}
+	}
+	return false
+}
+
+// preserveCase returns replace adapted to the case pattern of match
+func preserveCase(match, replace []byte) []byte {
+	var upper, lower int
+	var firstUpper, seenLetter bool
+	for len(match) > 0 {
+		r, size := utf8.DecodeRune(match)
+		match = match[size:]
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+			firstUpper = firstUpper || !seenLetter
+			seenLetter = true
+		case unicode.IsLower(r):
+			lower++
+			seenLetter = true
+		}
+	}
+	switch {
+	case upper == 0 && lower == 0:
+		return replace
+	case lower == 0 && upper > 1:
+		return bytes.ToUpper(replace)
+	case upper == 0:
+		return bytes.ToLower(replace)
+	case upper == 1 && firstUpper:
+		for i := 0; i < len(replace); {
+			r, size := utf8.DecodeRune(replace[i:])
+			switch {
+			case unicode.IsLetter(r):
+				title := make([]byte, 0, len(replace)+utf8.UTFMax)
+				title = append(title, replace[:i]...)
+				title = append(title, string(unicode.ToUpper(r))...)
+				return append(title, replace[i+size:]...)
+			}
+			i += size
+		}
+	}
+	return replace
+}
+
+// MappingReplacingReader allows transparent replacement of a literal token with MappingOptions during read operation.
+type MappingReplacingReader struct {
+	r       io.Reader
+	m       *keyMatcher
+	replace []byte
+	err     error
+	in      []byte // bytes read in but not yet processed
+	out     *bytes.Buffer
+	prev    int // last byte before r.in, -1 at the start of the input
+	seen    int // number of matches found so far, including the ones Occurrence did not select
+	matches int
+}
+
+// NewMappingReplacingReader creates a new `*MappingReplacingReader` replacing search with replace according to options.
+// `search` cannot be nil/empty. `replace` can.
+func NewMappingReplacingReader(r io.Reader, search, replace []byte, options MappingOptions) *MappingReplacingReader {
+	switch {
+	case r == nil:
+		panic("io.Reader cannot be nil")
+	case len(search) == 0:
+		panic("search token cannot be nil/empty")
+	}
+	m := newKeyMatcher(search, options)
+	return &MappingReplacingReader{
+		r:       r,
+		m:       m,
+		replace: replace,
+		// One more byte than the longest match, so the byte following it is always known
+		in:   make([]byte, 0, defaultBufSize+m.maxLen+1),
+		out:  bytes.NewBuffer(make([]byte, 0, defaultBufSize+m.maxLen)),
+		prev: -1,
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *MappingReplacingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		switch {
+		case r.err != nil && len(r.in) == 0:
+			return 0, r.err
+		}
+		for len(r.in) < cap(r.in) && r.err == nil {
+			n, err := r.r.Read(r.in[len(r.in):cap(r.in)])
+			r.in = r.in[:len(r.in)+n]
+			r.err = err
+		}
+		r.process()
+	}
+	return r.out.Read(p)
+}
+
+// process replaces every match that can be decided into r.out and drops the consumed input.
+func (r *MappingReplacingReader) process() {
+	final := r.err != nil
+	var last, i int
+scan:
+	for i < len(r.in) {
+		switch {
+		case r.m.options.Occurrence.exhausted(r.seen):
+			i = len(r.in)
+			break scan
+		case !r.m.first[r.in[i]]:
+			i++
+			continue
+		}
+		n, status := r.m.match(r.in[i:], final)
+		switch status {
+		case matchNeedMore:
+			break scan
+		case matchNone:
+			i++
+			continue
+		}
+		switch r.m.options.WholeWord {
+		case true:
+			switch {
+			case i+n == len(r.in) && !final:
+				break scan
+			case !r.boundary(i, n):
+				i++
+				continue
+			}
+		}
+		r.seen++
+		switch r.m.options.Occurrence.selected(r.seen) {
+		case false:
+			i += n
+			continue
+		}
+		r.out.Write(r.in[last:i])
+		switch r.m.options.PreserveCase {
+		case true:
+			r.out.Write(preserveCase(r.in[i:i+n], r.replace))
+		default:
+			r.out.Write(r.replace)
+		}
+		r.matches++
+		i += n
+		last = i
+	}
+	r.out.Write(r.in[last:i])
+	switch {
+	case i > 0:
+		r.prev = int(r.in[i-1])
+	}
+	r.in = r.in[:copy(r.in, r.in[i:])]
+}
+
+// boundary reports whether the match of n bytes at r.in[i] is surrounded by non-word characters
+func (r *MappingReplacingReader) boundary(i, n int) bool {
+	before := r.prev
+	switch {
+	case i > 0:
+		before = int(r.in[i-1])
+	}
+	switch {
+	case before >= 0 && r.m.word[before]:
+		return false
+	case i+n < len(r.in) && r.m.word[r.in[i+n]]:
+		return false
+	}
+	return true
+}
+
+// Matches returns the number of times the search token has been replaced so far, which
+// does not include matches that were left alone because Occurrence did not select them.
+func (r *MappingReplacingReader) Matches() int {
+	return r.matches
+}
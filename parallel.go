@@ -0,0 +1,325 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/zenthangplus/goccm"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+// defaultChunkSize is the number of bytes of the file every worker of a parallel replace scans at once
+const defaultChunkSize = 4 << 20
+
+// chunkMatch is a match found in a chunk, start is relative to the start of the chunk
+type chunkMatch struct {
+	start int
+	key   int
+}
+
+// chunkResult holds a scanned chunk of the file
+type chunkResult struct {
+	offset  int64  // offset of the chunk in the file
+	data    []byte // the chunk followed by up to maxLen-1 bytes of the next one, so straddling matches are complete
+	size    int    // length of the chunk itself, matches starting past it belong to the next chunk
+	matches []chunkMatch
+	err     error
+}
+
+// parallelReplacer scans chunks of a file on multiple goroutines and stitches the output back together in order
+type parallelReplacer struct {
+	file      *os.File
+	fileSize  int64
+	chunkSize int64
+	workers   int
+	ac        *ahoCorasick
+	replace   [][]byte
+	matches   []int
+}
+
+// ReplaceParallel does the replace operation on `workers` goroutines, see DoParallelReplace.
+func (rp *Replacer) ReplaceParallel(workers int) (*ReplaceReport, error) {
+	return rp.ReplaceParallelContext(context.Background(), workers)
+}
+
+// ReplaceParallelContext is like ReplaceParallel, but gives up as soon as ctx is done.
+// The temporary file is removed on cancellation and the original file is left untouched.
+func (rp *Replacer) ReplaceParallelContext(ctx context.Context, workers int) (*ReplaceReport, error) {
+	rp.Config.Semaphore.GCM.Wait()
+	return DoParallelReplaceContext(ctx, rp, workers)
+}
+
+// DoParallelReplace splits the file into chunks of Config.ChunkSize bytes that are scanned on `workers` goroutines
+// (runtime.NumCPU() if less than 1), and writes the output in order into the temporary file.
+// The mappings are matched like DoSimultaneousReplace does, and the output is exactly the same.
+func DoParallelReplace(rp *Replacer, workers int) (*ReplaceReport, error) {
+	return DoParallelReplaceContext(context.Background(), rp, workers)
+}
+
+// DoParallelReplaceContext is like DoParallelReplace, but checks ctx between chunks.
+func DoParallelReplaceContext(ctx context.Context, rp *Replacer, workers int) (*ReplaceReport, error) {
+	defer rp.Config.Semaphore.GCM.Done()
+	report := &ReplaceReport{Matches: make([]int, len(rp.Config.Mappings.Keys))}
+	start := time.Now()
+	switch err := rp.Config.Transformer.literal("in parallel"); err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	release, err := rp.acquire(ctx)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	defer release()
+	switch compressed, err := rp.compressed(); {
+	case err != nil:
+		return report, err
+	case compressed:
+		return report, fmt.Errorf("compressed files cannot be replaced in parallel")
+	}
+	input, err := os.Open(rp.Config.FilePath)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+	fd, err := input.Stat()
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	switch {
+	case workers < 1:
+		workers = runtime.NumCPU()
+	}
+	pr := &parallelReplacer{
+		file:      input,
+		fileSize:  fd.Size(),
+		chunkSize: rp.Config.ChunkSize,
+		workers:   workers,
+		ac:        newAhoCorasick(rp.Config.Mappings.Keys),
+		replace:   rp.Config.Mappings.Indices,
+		matches:   report.Matches,
+	}
+	switch {
+	case pr.chunkSize <= 0:
+		pr.chunkSize = defaultChunkSize
+	}
+	switch {
+	case pr.chunkSize < int64(pr.ac.maxLen):
+		// A match may straddle at most one chunk boundary
+		pr.chunkSize = int64(pr.ac.maxLen)
+	}
+	switch rp.Config.DryRun {
+	case true:
+		reader, writer := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := pr.run(ctx, writer)
+			_ = writer.CloseWithError(err)
+			done <- err
+		}()
+		report.BytesWritten, err = rp.dryRun(ctx, reader, nil)
+		_ = reader.Close()
+		switch perr := <-done; {
+		case err == nil && perr != io.ErrClosedPipe:
+			err = perr
+		}
+		report.BytesRead = pr.fileSize
+		report.Duration = time.Since(start)
+		return report, err
+	}
+	output, err := createTemp(rp.Config.FilePath, rp.Config.FilePerm)
+	switch err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	buffered := bufio.NewWriterSize(output, 65536)
+	wrote, err := pr.run(ctx, buffered)
+	switch err {
+	case nil:
+		err = buffered.Flush()
+	}
+	switch err {
+	case nil:
+		break
+	default:
+		discardTemp(output)
+		return report, err
+	}
+	report.BytesRead = pr.fileSize
+	report.BytesWritten = wrote
+	switch err := rp.commit(output, report); err {
+	case nil:
+		break
+	default:
+		return report, err
+	}
+	report.TempPath = output.Name()
+	rp.Config.FileSize = wrote
+	rp.Config.Transformer.Reset()
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// run scans the chunks on the workers and writes the stitched output to w, returning the number of bytes written.
+// At most 2*workers chunks are held in memory at once.
+func (pr *parallelReplacer) run(ctx context.Context, w io.Writer) (int64, error) {
+	queue := make(chan chan *chunkResult, pr.workers)
+	done := make(chan struct{})
+	defer close(done)
+	gcm := goccm.New(pr.workers)
+	go func() {
+		defer close(queue)
+		for offset := int64(0); offset < pr.fileSize; offset += pr.chunkSize {
+			result := make(chan *chunkResult, 1)
+			select {
+			case queue <- result:
+			case <-done:
+				return
+			}
+			gcm.Wait()
+			go func(offset int64) {
+				defer gcm.Done()
+				result <- pr.scan(offset)
+			}(offset)
+		}
+	}()
+	var written, pos int64
+	for result := range queue {
+		switch err := ctx.Err(); err {
+		case nil:
+			break
+		default:
+			return written, err
+		}
+		chunk := <-result
+		switch chunk.err {
+		case nil:
+			break
+		default:
+			return written, chunk.err
+		}
+		wrote, next, err := pr.stitch(w, chunk, int(pos-chunk.offset))
+		written += wrote
+		switch err {
+		case nil:
+			break
+		default:
+			return written, err
+		}
+		pos = next
+	}
+	return written, ctx.Err()
+}
+
+// scan reads the chunk at offset along with the overlap into the next chunk and finds all of its matches
+func (pr *parallelReplacer) scan(offset int64) *chunkResult {
+	chunk := &chunkResult{offset: offset}
+	size := pr.chunkSize
+	switch {
+	case offset+size > pr.fileSize:
+		size = pr.fileSize - offset
+	}
+	overlap := int64(max(pr.ac.maxLen-1, 0))
+	switch {
+	case offset+size+overlap > pr.fileSize:
+		overlap = pr.fileSize - offset - size
+	}
+	chunk.size = int(size)
+	chunk.data = make([]byte, size+overlap)
+	n, err := pr.file.ReadAt(chunk.data, offset)
+	switch {
+	case err == io.EOF && n == len(chunk.data):
+		break
+	case err != nil:
+		chunk.err = err
+		return chunk
+	}
+	chunk.matches = pr.matchesFrom(chunk, 0, nil)
+	return chunk
+}
+
+// matchesFrom returns the matches of chunk starting at or after from. If known holds the matches found by a scan that
+// started elsewhere, the scan stops as soon as both agree on a match, since they are identical from there on.
+func (pr *parallelReplacer) matchesFrom(chunk *chunkResult, from int, known []chunkMatch) []chunkMatch {
+	matches := make([]chunkMatch, 0)
+	for {
+		start, key, _ := pr.ac.leftmostLongest(chunk.data, from, true)
+		switch {
+		case start < 0 || start >= chunk.size:
+			return matches
+		}
+		for len(known) > 0 && known[0].start < start {
+			known = known[1:]
+		}
+		switch {
+		case len(known) > 0 && known[0].start == start && known[0].key == key:
+			return append(matches, known...)
+		}
+		matches = append(matches, chunkMatch{start: start, key: key})
+		from = start + pr.ac.lengths[key]
+	}
+}
+
+// stitch writes the output of chunk to w, skipping the first `from` bytes which were consumed by a match that
+// started in the previous chunk. It returns the number of bytes written and the file offset the next chunk continues at.
+func (pr *parallelReplacer) stitch(w io.Writer, chunk *chunkResult, from int) (int64, int64, error) {
+	matches := chunk.matches
+	switch {
+	case from > 0:
+		// The chunk was scanned from its start, which may have found matches overlapping the straddling one
+		matches = pr.matchesFrom(chunk, from, matches)
+	}
+	var written int64
+	write := func(p []byte) error {
+		n, err := w.Write(p)
+		written += int64(n)
+		return err
+	}
+	for _, match := range matches {
+		switch err := write(chunk.data[from:match.start]); err {
+		case nil:
+			break
+		default:
+			return written, 0, err
+		}
+		switch err := write(pr.replace[match.key]); err {
+		case nil:
+			break
+		default:
+			return written, 0, err
+		}
+		pr.matches[match.key]++
+		from = match.start + pr.ac.lengths[match.key]
+	}
+	switch {
+	case from < chunk.size:
+		switch err := write(chunk.data[from:chunk.size]); err {
+		case nil:
+			break
+		default:
+			return written, 0, err
+		}
+		from = chunk.size
+	}
+	return written, chunk.offset + int64(from), nil
+}
@@ -0,0 +1,155 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/zenthangplus/goccm"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Pool runs replace operations concurrently, with at most a fixed number of them running at once.
+// Results are delivered on Results() as soon as every operation completes, so the channel has to be
+// drained while submitting, typically from another goroutine.
+type Pool struct {
+	// Configure is called on the Replacer of every file submitted with SubmitFile before it is replaced
+	Configure func(*Replacer)
+	gcm       goccm.ConcurrencyManager
+	results   chan *FileReport
+	mu        sync.Mutex
+	failed    ReplaceErrors
+}
+
+// ReplaceErrors holds the reports of every failed replace operation of a Pool
+type ReplaceErrors []*FileReport
+
+// Error implements the `error` interface.
+func (errs ReplaceErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, report := range errs {
+		messages = append(messages, fmt.Sprintf("%s: %s", report.Path, report.Err.Error()))
+	}
+	return fmt.Sprintf("%d replace operations failed: %s", len(errs), strings.Join(messages, "; "))
+}
+
+// NewPool returns a new *Pool type running at most limit replace operations at once
+func NewPool(limit int) *Pool {
+	switch {
+	case limit < 1:
+		limit = 1
+	}
+	return &Pool{
+		gcm:     goccm.New(limit),
+		results: make(chan *FileReport, limit),
+	}
+}
+
+// Results returns the channel every FileReport is delivered on. It is closed by Close.
+func (p *Pool) Results() <-chan *FileReport {
+	return p.results
+}
+
+// Submit replaces rp in the background, blocking until there is a free slot.
+// The mappings are applied simultaneously if rp.Config.Transformer.Simultaneous is set, chained otherwise.
+func (p *Pool) Submit(ctx context.Context, rp *Replacer) {
+	p.run(func() *FileReport {
+		report := &FileReport{Path: rp.Config.FilePath}
+		report.Report, report.Err = rp.replace(ctx)
+		return report
+	})
+}
+
+// SubmitFile replaces the file at path with a copy of the mappings of t in the background, blocking until there is a free slot.
+func (p *Pool) SubmitFile(ctx context.Context, path string, t *Transformer) {
+	p.run(func() *FileReport {
+		return replaceFile(ctx, path, t, p.Configure)
+	})
+}
+
+// Close waits for every submitted operation to complete and closes Results.
+// It returns a ReplaceErrors holding all of the failed operations, or nil if none failed.
+func (p *Pool) Close() error {
+	p.gcm.WaitAllDone()
+	close(p.results)
+	switch len(p.failed) {
+	case 0:
+		return nil
+	default:
+		return p.failed
+	}
+}
+
+// run executes replace on its own goroutine once a slot is free
+func (p *Pool) run(replace func() *FileReport) {
+	p.gcm.Wait()
+	go func() {
+		defer p.gcm.Done()
+		report := replace()
+		switch report.Err {
+		case nil:
+			break
+		default:
+			p.mu.Lock()
+			p.failed = append(p.failed, report)
+			p.mu.Unlock()
+		}
+		p.results <- report
+	}()
+}
+
+// replaceFile replaces the file at path with a copy of the mappings of t, calling configure on the Replacer first
+func replaceFile(ctx context.Context, path string, t *Transformer, configure func(*Replacer)) *FileReport {
+	report := &FileReport{Path: path}
+	rp, err := NewReplacer(path)
+	switch err {
+	case nil:
+		break
+	default:
+		report.Err = err
+		return report
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Close()
+	}(rp)
+	rp.Config.Transformer = t.clone()
+	rp.Config.Mappings = rp.Config.Transformer.Mappings
+	switch {
+	case configure != nil:
+		configure(rp)
+	}
+	report.Report, report.Err = rp.replace(ctx)
+	switch w := rp.Config.DiffOutput.(type) {
+	case *lockedWriter:
+		switch err := w.flush(); {
+		case err != nil && report.Err == nil:
+			report.Err = err
+		}
+	}
+	return report
+}
+
+// lockedWriter holds back the diff of a single file and writes it out in one go, so that the diffs of
+// files replaced concurrently do not interleave
+type lockedWriter struct {
+	w   io.Writer
+	mu  *sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements the `io.Writer` interface.
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// flush writes everything held back to the underlying writer
+func (w *lockedWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.buf.WriteTo(w.w)
+	return err
+}
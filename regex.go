@@ -0,0 +1,167 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"regexp/syntax"
+)
+
+// defaultRegexMaxMatch is the default upper bound (in bytes) of a single regular expression match
+const defaultRegexMaxMatch = 8192
+
+// RegexReplacingReader allows transparent replacement of regular expression matches during read operation.
+// Input is scanned through a sliding window so that the whole stream never has to be buffered, which
+// means a single match can never be longer than `maxMatch` bytes. Windows are cut on line boundaries
+// whenever possible, so `^` and `$` behave like they do in sed when used with the `(?m)` flag. Without it,
+// `^` and `\A` only match at the start of the stream.
+type RegexReplacingReader struct {
+	r        io.Reader
+	re       *regexp.Regexp
+	inner    *regexp.Regexp // re without its start of text anchors, used past the first window (nil if it has none)
+	started  bool           // true once input was consumed, so the window no longer starts the stream
+	template []byte
+	maxMatch int
+	err      error
+	in       []byte // bytes read in but not yet processed
+	out      *bytes.Buffer
+	expanded []byte // scratch space for template expansion
+	abutting bool   // true when the previous window ended with a match, so an empty match at the start is skipped
+	matches  int    // number of matches replaced so far
+}
+
+// NewRegexReplacingReader creates a new `*RegexReplacingReader`.
+// `template` may contain `$1` or `${name}` references to submatches, see `regexp.Regexp.Expand`.
+// `maxMatch` bounds the length of a single match, values <= 0 fall back to the default.
+func NewRegexReplacingReader(r io.Reader, re *regexp.Regexp, template []byte, maxMatch int) *RegexReplacingReader {
+	switch {
+	case r == nil:
+		panic("io.Reader cannot be nil")
+	case re == nil:
+		panic("regular expression cannot be nil")
+	case maxMatch <= 0:
+		maxMatch = defaultRegexMaxMatch
+	}
+	return &RegexReplacingReader{
+		r:        r,
+		re:       re,
+		inner:    withoutBeginText(re),
+		template: template,
+		maxMatch: maxMatch,
+		in:       make([]byte, 0, defaultBufSize+maxMatch),
+		out:      bytes.NewBuffer(make([]byte, 0, defaultBufSize+maxMatch)),
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *RegexReplacingReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		switch {
+		case r.err != nil && len(r.in) == 0:
+			return 0, r.err
+		}
+		r.fill()
+		r.process()
+	}
+	return r.out.Read(p)
+}
+
+// fill reads from the underlying reader until a full window is buffered or the reader is exhausted.
+func (r *RegexReplacingReader) fill() {
+	for len(r.in) < cap(r.in) && r.err == nil {
+		n, err := r.r.Read(r.in[len(r.in):cap(r.in)])
+		r.in = r.in[:len(r.in)+n]
+		r.err = err
+	}
+}
+
+// process expands every match starting in the safe part of the window into r.out and drops the consumed input.
+func (r *RegexReplacingReader) process() {
+	final := r.err != nil
+	limit := len(r.in)
+	switch final {
+	case false:
+		// Only matches starting before `limit` are guaranteed to see their full `maxMatch` bytes of input
+		limit -= r.maxMatch
+		switch nl := bytes.LastIndexByte(r.in[:limit], '\n'); {
+		case nl >= 0:
+			limit = nl + 1
+		}
+	}
+	re := r.re
+	switch {
+	case r.started && r.inner != nil:
+		re = r.inner
+	}
+	var last int
+	var matched bool
+Loop:
+	for _, match := range re.FindAllSubmatchIndex(r.in, -1) {
+		switch {
+		case match[0] >= limit && !final:
+			break Loop
+		case match[0] == 0 && match[1] == 0 && r.abutting:
+			continue
+		}
+		r.expanded = r.re.Expand(r.expanded[:0], r.template, r.in, match)
+		r.out.Write(r.in[last:match[0]])
+		r.out.Write(r.expanded)
+		last = match[1]
+		matched = true
+		r.matches++
+	}
+	cut := limit
+	switch {
+	case last > cut:
+		cut = last
+	}
+	r.out.Write(r.in[last:cut])
+	r.abutting = matched && last == cut
+	r.started = r.started || cut > 0
+	r.in = r.in[:copy(r.in, r.in[cut:])]
+}
+
+// withoutBeginText returns re with `\A` (and `^` without the `(?m)` flag) made unable to match, as the windows after
+// the first one do not start the text. It returns nil if re has no such anchor. The submatches are numbered and
+// named the same, but a regular expression made leftmost-longest with `Longest` is not.
+func withoutBeginText(re *regexp.Regexp) *regexp.Regexp {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil
+	}
+	var found bool
+	var walk func(node *syntax.Regexp)
+	walk = func(node *syntax.Regexp) {
+		switch node.Op {
+		case syntax.OpBeginText:
+			node.Op = syntax.OpNoMatch
+			found = true
+		}
+		for _, sub := range node.Sub {
+			walk(sub)
+		}
+	}
+	walk(parsed)
+	switch found {
+	case false:
+		return nil
+	}
+	inner, err := regexp.Compile(parsed.String())
+	switch err {
+	case nil:
+		return inner
+	default:
+		return nil
+	}
+}
+
+// Matches returns the number of matches replaced so far.
+func (r *RegexReplacingReader) Matches() int {
+	return r.matches
+}
@@ -0,0 +1,74 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"io"
+	"time"
+)
+
+// ReplaceReport describes the outcome of a replace operation
+type ReplaceReport struct {
+	// Matches holds the number of matches of every mapping, in the order the mappings were added
+	Matches []int
+	// BytesRead is the number of bytes read from the original file
+	BytesRead int64
+	// BytesWritten is the size of the rewritten file
+	BytesWritten int64
+	// Duration is the time the operation took, excluding the time spent waiting on the semaphore
+	Duration time.Duration
+	// TempPath is the temporary file that was renamed over the original, empty for dry runs
+	TempPath string
+	// BackupPath is the backup of the original file, empty if Config.Backup is not set or for dry runs
+	BackupPath string
+	// Compression is the compression of the file. BytesRead counts its compressed bytes, and so does BytesWritten
+	// unless it is a dry run.
+	Compression Compression
+}
+
+// TotalMatches returns the number of matches across all mappings
+func (report *ReplaceReport) TotalMatches() int {
+	var total int
+	for _, matches := range report.Matches {
+		total += matches
+	}
+	return total
+}
+
+// matchCounter is implemented by the single-mapping replacing readers
+type matchCounter interface {
+	Matches() int
+}
+
+// pipeline is a replacing reader along with a function that returns the match count of every mapping it replaces
+type pipeline struct {
+	io.Reader
+	matches func() []int
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+// Read implements the `io.Reader` interface.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+// Write implements the `io.Writer` interface.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,771 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// scriptCommand marks the entries of the mappings that run a Script, Keys holds its source and Indices its flags: "n"
+// if it is quiet and "E" if it uses extended regular expressions
+const scriptCommand LineCommand = '#'
+
+// Script is a parsed sed script. It supports addresses (see Address), `{...}` blocks and `#` comments, and the
+// commands `s`, `y`, `p`, `P`, `d`, `D`, `n`, `N`, `a`, `i`, `c`, `=`, `h`, `H`, `g`, `G`, `x`, `z`, `b`, `t`, `T`,
+// `:label`, `q` and `Q`. Regular expressions are POSIX basic regular expressions with the GNU extensions, like in
+// sed, or extended ones for ParseExtendedScript, like `sed -E`. They are run by the regexp package, so
+// back-references in patterns are not supported. `s` supports the flags `g`, `p`, `I`, `M` and a number, and the case
+// conversions `\U`, `\L`, `\u`, `\l` and `\E` of GNU sed in the replacement. An empty
+// regular expression (`//` or `s//.../`) stands for the last one before it in the script. Commands that read or write
+// other files (`r`, `R`, `w`, `W` and `e`) are not supported. A Script keeps no state of its own, so it can be run any
+// number of times.
+type Script struct {
+	// Quiet disables printing the pattern space at the end of every cycle, like `sed -n` or a first line of `#n`
+	Quiet        bool
+	source       string
+	syntax       regexSyntax
+	instructions []*instruction
+}
+
+// instruction is a single command of a Script
+type instruction struct {
+	address *Address // nil if the command applies to every line
+	name    byte
+	text    []byte // a, i and c
+	label   string // :, b, t and T
+	target  int    // b, t and T jump to this instruction, { skips to it if its address does not match
+	re      *regexp.Regexp
+	replace []replacePart
+	global  bool
+	nth     int
+	print   bool
+	table   map[rune]rune // y
+}
+
+// replacePart is either a literal part of the replacement of an s command, a reference to a submatch or a case
+// conversion
+type replacePart struct {
+	literal []byte
+	group   int  // -1 for a literal or a case conversion
+	convert byte // U, L, E, u or l for a case conversion
+}
+
+// ParseScript parses a sed script, see Script. Several `-e` expressions or script files are joined with newlines.
+func ParseScript(script string) (*Script, error) {
+	return parseSyntax(script, syntaxBasic)
+}
+
+// ParseExtendedScript parses a sed script that uses extended regular expressions, like `sed -E`, see ParseScript
+func ParseExtendedScript(script string) (*Script, error) {
+	return parseSyntax(script, syntaxExtended)
+}
+
+// parseSyntax parses a sed script whose regular expressions use syntax
+func parseSyntax(script string, syntax regexSyntax) (*Script, error) {
+	instructions, err := parseScript(script, &regexScope{syntax: syntax})
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	return &Script{
+		Quiet:        script == "#n" || strings.HasPrefix(script, "#n\n"),
+		source:       script,
+		syntax:       syntax,
+		instructions: instructions,
+	}, nil
+}
+
+// Reader returns a reader that runs the script on everything read from r
+func (s *Script) Reader(r io.Reader) io.Reader {
+	return s.reader(r)
+}
+
+// Bytes returns the output of the script for the input b
+func (s *Script) Bytes(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := io.Copy(&out, s.reader(bytes.NewReader(b)))
+	return out.Bytes(), err
+}
+
+// parseScript parses the instructions of a script, compiling its regular expressions in scope, and resolves its
+// blocks and labels
+func parseScript(s string, scope *regexScope) ([]*instruction, error) {
+	instructions := make([]*instruction, 0)
+	blocks := make([]int, 0)
+	labels := make(map[string]int)
+	for {
+		s = strings.TrimLeft(s, " \t\n;")
+		switch {
+		case s == "":
+			return resolveScript(instructions, blocks, labels)
+		case s[0] == '#':
+			switch end := strings.IndexByte(s, '\n'); {
+			case end < 0:
+				s = ""
+			default:
+				s = s[end:]
+			}
+			continue
+		}
+		address, rest, err := parseAddress(s, scope)
+		switch {
+		case err != nil:
+			return nil, err
+		case rest == "":
+			return nil, fmt.Errorf("missing command after %q", s)
+		}
+		in := &instruction{address: address, name: rest[0], nth: 1}
+		rest = rest[1:]
+		switch in.name {
+		case '{':
+			blocks = append(blocks, len(instructions))
+		case '}':
+			switch {
+			case address != nil:
+				return nil, fmt.Errorf("} does not take an address")
+			case len(blocks) == 0:
+				return nil, fmt.Errorf("unexpected }")
+			}
+			instructions[blocks[len(blocks)-1]].target = len(instructions)
+			blocks = blocks[:len(blocks)-1]
+		case '=', 'd', 'D', 'g', 'G', 'h', 'H', 'n', 'N', 'p', 'P', 'x', 'z', 'q', 'Q':
+			break
+		case 'a', 'i', 'c':
+			var text string
+			text, rest = parseText(rest)
+			in.text = []byte(text)
+		case ':':
+			switch {
+			case address != nil:
+				return nil, fmt.Errorf(": does not take an address")
+			}
+			in.label, rest = parseLabel(rest)
+			_, duplicate := labels[in.label]
+			switch {
+			case in.label == "":
+				return nil, fmt.Errorf("missing label for :")
+			case duplicate:
+				return nil, fmt.Errorf("duplicate label %q", in.label)
+			}
+			labels[in.label] = len(instructions)
+		case 'b', 't', 'T':
+			in.label, rest = parseLabel(rest)
+		case 's':
+			rest, err = in.parseSubstitute(rest, scope)
+		case 'y':
+			rest, err = in.parseTranslate(rest)
+		case 'r', 'R', 'w', 'W', 'e':
+			return nil, fmt.Errorf("the %c command is not supported", in.name)
+		default:
+			return nil, fmt.Errorf("unknown command %q", in.name)
+		}
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+		instructions = append(instructions, in)
+		// A command ends at a semicolon, a newline, a closing brace or a comment
+		rest = strings.TrimLeft(rest, " \t")
+		switch {
+		case in.name != '{' && rest != "" && !strings.ContainsAny(rest[:1], ";\n}#"):
+			return nil, fmt.Errorf("unexpected %q after the %c command", rest, in.name)
+		}
+		s = rest
+	}
+}
+
+// resolveScript checks that every block is closed and points the jumps at their labels
+func resolveScript(instructions []*instruction, blocks []int, labels map[string]int) ([]*instruction, error) {
+	switch {
+	case len(blocks) > 0:
+		return nil, fmt.Errorf("unmatched {")
+	}
+	for _, in := range instructions {
+		switch in.name {
+		case 'b', 't', 'T':
+			break
+		default:
+			continue
+		}
+		target, ok := labels[in.label]
+		switch {
+		case in.label == "":
+			in.target = len(instructions)
+		case !ok:
+			return nil, fmt.Errorf("cannot find label %q", in.label)
+		default:
+			in.target = target
+		}
+	}
+	return instructions, nil
+}
+
+// parseLabel parses the label argument of the :, b, t and T commands
+func parseLabel(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t")
+	end := strings.IndexAny(s, "; \t\n}")
+	switch {
+	case end < 0:
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// parseText parses the text argument of the a, i and c commands, both in the one-line form `a text` and the
+// classic form `a\` followed by lines that continue as long as they end with a backslash
+func parseText(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case strings.HasPrefix(s, "\\\n"):
+		s = s[2:]
+	case strings.HasPrefix(s, "\\"):
+		s = s[1:]
+	}
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			// An escaped newline continues the text, every other escaped character is taken literally
+			text.WriteByte(s[i+1])
+			i++
+		case s[i] == '\n':
+			return text.String(), s[i:]
+		default:
+			text.WriteByte(s[i])
+		}
+	}
+	return text.String(), ""
+}
+
+// parseSubstitute parses the arguments of an s command and compiles its regular expression in scope
+func (in *instruction) parseSubstitute(s string, scope *regexScope) (string, error) {
+	switch {
+	case s == "" || s[0] == '\\' || s[0] == '\n':
+		return s, fmt.Errorf("invalid delimiter for the s command")
+	}
+	delim := s[0]
+	pattern, rest, err := splitDelimited(s[1:], delim, scope.unescapeDelimiter(delim))
+	switch err {
+	case nil:
+		break
+	default:
+		return s, fmt.Errorf("unterminated s command")
+	}
+	in.replace, rest, err = parseReplacement(rest, delim)
+	switch err {
+	case nil:
+		break
+	default:
+		return s, err
+	}
+	var flags string
+	for len(rest) > 0 && strings.ContainsAny(rest[:1], "gpIiMm123456789we") {
+		switch c := rest[0]; {
+		case c == 'g':
+			in.global = true
+		case c == 'p':
+			in.print = true
+		case c == 'I' || c == 'i':
+			flags += "i"
+		case c == 'M' || c == 'm':
+			flags += "m"
+		case c == 'w' || c == 'e':
+			return rest, fmt.Errorf("the %c flag of the s command is not supported", c)
+		default:
+			in.nth, rest = leadingNumber(rest)
+			continue
+		}
+		rest = rest[1:]
+	}
+	return rest, in.compile(pattern, flags, scope)
+}
+
+// compile compiles the regular expression of an s command and checks the submatches its replacement refers to
+func (in *instruction) compile(pattern, flags string, scope *regexScope) error {
+	re, err := scope.compile(pattern, flags)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	for _, part := range in.replace {
+		switch {
+		case part.group > re.NumSubexp():
+			return fmt.Errorf("invalid reference \\%d in the replacement of %q", part.group, pattern)
+		}
+	}
+	in.re = re
+	return nil
+}
+
+// parseReplacement parses the replacement of an s command up to the delimiter. `&` and `\0` to `\9` refer to
+// the match and its submatches, `\n` and `\t` are a newline and a tab, `\U`, `\L`, `\u`, `\l` and `\E` convert
+// the case of what follows them, and every other escape is taken literally.
+func parseReplacement(s string, delim byte) ([]replacePart, string, error) {
+	parts := make([]replacePart, 0)
+	var literal []byte
+	part := func(p replacePart) {
+		switch len(literal) {
+		case 0:
+			break
+		default:
+			parts = append(parts, replacePart{literal: literal, group: -1})
+			literal = nil
+		}
+		parts = append(parts, p)
+	}
+	group := func(n int) {
+		part(replacePart{group: n})
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch e := s[i]; {
+			case e == delim:
+				literal = append(literal, e)
+			case e >= '0' && e <= '9':
+				group(int(e - '0'))
+			case e == 'n':
+				literal = append(literal, '\n')
+			case e == 't':
+				literal = append(literal, '\t')
+			case strings.IndexByte("ULEul", e) >= 0:
+				part(replacePart{group: -1, convert: e})
+			default:
+				literal = append(literal, e)
+			}
+		case c == delim:
+			switch len(literal) {
+			case 0:
+				break
+			default:
+				parts = append(parts, replacePart{literal: literal, group: -1})
+			}
+			return parts, s[i+1:], nil
+		case c == '&':
+			group(0)
+		default:
+			literal = append(literal, c)
+		}
+	}
+	return nil, s, fmt.Errorf("unterminated s command")
+}
+
+// parseTranslate parses the arguments of a y command
+func (in *instruction) parseTranslate(s string) (string, error) {
+	switch {
+	case s == "" || s[0] == '\\' || s[0] == '\n':
+		return s, fmt.Errorf("invalid delimiter for the y command")
+	}
+	delim := s[0]
+	from, rest, err := splitTranslate(s[1:], delim)
+	switch err {
+	case nil:
+		break
+	default:
+		return s, err
+	}
+	to, rest, err := splitTranslate(rest, delim)
+	switch {
+	case err != nil:
+		return s, err
+	case len(from) != len(to):
+		return s, fmt.Errorf("the strings of the y command have different lengths")
+	}
+	in.table = make(map[rune]rune, len(from))
+	for i, r := range from {
+		in.table[r] = to[i]
+	}
+	return rest, nil
+}
+
+// splitTranslate parses one of the strings of a y command up to the delimiter
+func splitTranslate(s string, delim byte) ([]rune, string, error) {
+	var part []rune
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == 'n':
+			part = append(part, '\n')
+			i += 2
+			continue
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+		case s[i] == delim:
+			return part, s[i+1:], nil
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		part = append(part, r)
+		i += size
+	}
+	return nil, s, fmt.Errorf("unterminated y command")
+}
+
+// scriptReader runs a Script on the lines of its input
+type scriptReader struct {
+	script      *Script
+	addresses   []*Address // copies of the addresses of the instructions, which keep the state of their ranges
+	lines       *lineScanner
+	pattern     []byte
+	hold        []byte
+	chomped     bool // the pattern space ends with a newline, which is only false for a last line without one
+	holdChomped bool
+	pending     bool // a newline is owed before the next output
+	appended    [][]byte
+	substituted bool
+	restart     bool // D restarts the cycle without reading a new line
+	quit        bool
+	done        bool
+	matches     int
+	out         bytes.Buffer
+}
+
+// reader returns a reader running the script on the lines of r
+func (s *Script) reader(r io.Reader) *scriptReader {
+	addresses := make([]*Address, len(s.instructions))
+	for index, in := range s.instructions {
+		switch in.address {
+		case nil:
+			break
+		default:
+			address := *in.address
+			addresses[index] = &address
+		}
+	}
+	return &scriptReader{
+		script:      s,
+		addresses:   addresses,
+		lines:       newLineScanner(r),
+		holdChomped: true,
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (r *scriptReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		switch r.done {
+		case true:
+			switch r.quit {
+			case true:
+				return 0, io.EOF
+			}
+			return 0, r.lines.err
+		}
+		r.cycle()
+	}
+	return r.out.Read(p)
+}
+
+// Matches returns the number of substitutions made and lines edited by the script so far
+func (r *scriptReader) Matches() int {
+	return r.matches
+}
+
+// cycle runs the script on the next line of the input
+func (r *scriptReader) cycle() {
+	switch {
+	case r.quit:
+		r.done = true
+		return
+	case r.restart:
+		r.restart = false
+	case !r.read():
+		r.done = true
+		return
+	}
+	switch print := r.run(); {
+	case print && !r.script.Quiet:
+		r.emit(r.pattern, r.chomped)
+	}
+	r.flush()
+}
+
+// read replaces the pattern space with the next line, it returns false at the end of the input
+func (r *scriptReader) read() bool {
+	line, ok := r.lines.scan()
+	switch ok {
+	case false:
+		return false
+	}
+	content, terminator := splitTerminator(line)
+	r.pattern, r.chomped, r.substituted = content, terminator != nil, false
+	return true
+}
+
+// run executes the instructions on the pattern space and reports whether it is printed at the end of the cycle
+func (r *scriptReader) run() bool {
+	instructions := r.script.instructions
+	for pc := 0; pc < len(instructions); pc++ {
+		in := instructions[pc]
+		switch address := r.addresses[pc]; {
+		case address != nil && !address.match(r.pattern, r.lines.number, r.lines.last()):
+			switch in.name {
+			case '{':
+				pc = in.target
+			}
+			continue
+		}
+		switch in.name {
+		case '=':
+			r.emit([]byte(strconv.Itoa(r.lines.number)), true)
+		case 'a':
+			r.matches++
+			r.appended = append(r.appended, in.text)
+		case 'i':
+			r.matches++
+			r.emit(in.text, true)
+		case 'c':
+			// A range is changed as a whole once it ends
+			r.matches++
+			switch {
+			case r.addresses[pc].closed():
+				r.emit(in.text, true)
+			}
+			return false
+		case 'd':
+			r.matches++
+			return false
+		case 'D':
+			r.matches++
+			newline := bytes.IndexByte(r.pattern, '\n')
+			switch {
+			case newline >= 0:
+				r.pattern, r.restart = r.pattern[newline+1:], true
+			}
+			return false
+		case 'n':
+			switch {
+			case r.lines.last():
+				return true
+			case !r.script.Quiet:
+				r.emit(r.pattern, r.chomped)
+			}
+			r.flush()
+			r.read()
+		case 'N':
+			switch {
+			case r.lines.last():
+				return true
+			}
+			r.flush()
+			pattern := append(r.pattern, '\n')
+			r.read()
+			r.pattern = append(pattern, r.pattern...)
+		case 'p':
+			r.emit(r.pattern, r.chomped)
+		case 'P':
+			switch newline := bytes.IndexByte(r.pattern, '\n'); {
+			case newline >= 0:
+				r.emit(r.pattern[:newline], true)
+			default:
+				r.emit(r.pattern, r.chomped)
+			}
+		case 'h':
+			r.hold, r.holdChomped = append(r.hold[:0], r.pattern...), r.chomped
+		case 'H':
+			r.hold, r.holdChomped = append(append(r.hold, '\n'), r.pattern...), r.chomped
+		case 'g':
+			r.pattern, r.chomped = append(r.pattern[:0], r.hold...), r.holdChomped
+		case 'G':
+			r.pattern, r.chomped = append(append(r.pattern, '\n'), r.hold...), r.holdChomped
+		case 'x':
+			r.pattern, r.hold = r.hold, r.pattern
+			r.chomped, r.holdChomped = r.holdChomped, r.chomped
+		case 'z':
+			r.pattern = r.pattern[:0]
+		case 'b':
+			pc = in.target - 1
+		case 't':
+			switch r.substituted {
+			case true:
+				r.substituted = false
+				pc = in.target - 1
+			}
+		case 'T':
+			switch r.substituted {
+			case true:
+				r.substituted = false
+			default:
+				pc = in.target - 1
+			}
+		case 'q':
+			r.quit = true
+			return true
+		case 'Q':
+			r.quit = true
+			return false
+		case 's':
+			r.substitute(in)
+		case 'y':
+			r.translate(in)
+		}
+	}
+	return true
+}
+
+// substitute runs an s command on the pattern space
+func (r *scriptReader) substitute(in *instruction) {
+	matches := in.re.FindAllSubmatchIndex(r.pattern, -1)
+	switch {
+	case len(matches) < in.nth:
+		return
+	case in.global:
+		matches = matches[in.nth-1:]
+	default:
+		matches = matches[in.nth-1 : in.nth]
+	}
+	var out []byte
+	var last int
+	for _, match := range matches {
+		out = append(out, r.pattern[last:match[0]]...)
+		// The case conversions last until the end of the replacement
+		var mode, next byte
+		for _, part := range in.replace {
+			switch {
+			case part.convert == 'u' || part.convert == 'l':
+				next = part.convert
+			case part.convert != 0:
+				mode = part.convert
+			case part.group < 0:
+				out = convertCase(out, part.literal, mode, &next)
+			case match[2*part.group] >= 0:
+				out = convertCase(out, r.pattern[match[2*part.group]:match[2*part.group+1]], mode, &next)
+			}
+		}
+		last = match[1]
+	}
+	r.pattern = append(out, r.pattern[last:]...)
+	r.substituted = true
+	r.matches += len(matches)
+	switch in.print {
+	case true:
+		r.emit(r.pattern, r.chomped)
+	}
+}
+
+// convertCase appends text to out in the case set by `\U` or `\L` (mode), with its first character in the case set by
+// a pending `\u` or `\l` (next), which is cleared once it is applied
+func convertCase(out, text []byte, mode byte, next *byte) []byte {
+	switch mode {
+	case 'U':
+		text = bytes.ToUpper(text)
+	case 'L':
+		text = bytes.ToLower(text)
+	}
+	switch {
+	case *next == 0 || len(text) == 0:
+		return append(out, text...)
+	}
+	c, size := utf8.DecodeRune(text)
+	upper := *next == 'u'
+	*next = 0
+	switch {
+	case c == utf8.RuneError && size <= 1:
+		// An invalid byte is kept as it is
+		return append(out, text...)
+	case upper:
+		c = unicode.ToUpper(c)
+	default:
+		c = unicode.ToLower(c)
+	}
+	var buf [utf8.UTFMax]byte
+	out = append(out, buf[:utf8.EncodeRune(buf[:], c)]...)
+	return append(out, text[size:]...)
+}
+
+// translate runs a y command on the pattern space
+func (r *scriptReader) translate(in *instruction) {
+	out := make([]byte, 0, len(r.pattern))
+	var changed bool
+	for i := 0; i < len(r.pattern); {
+		c, size := utf8.DecodeRune(r.pattern[i:])
+		switch to, ok := in.table[c]; {
+		case ok && (c != utf8.RuneError || size > 1):
+			out = append(out, string(to)...)
+			changed = changed || to != c
+		default:
+			out = append(out, r.pattern[i:i+size]...)
+		}
+		i += size
+	}
+	r.pattern = out
+	switch changed {
+	case true:
+		r.matches++
+	}
+}
+
+// emit writes a line of output. Without newline, the newline is held back until there is more output,
+// so the output only lacks a final newline where the input does.
+func (r *scriptReader) emit(text []byte, newline bool) {
+	switch r.pending {
+	case true:
+		r.out.WriteByte('\n')
+		r.pending = false
+	}
+	r.out.Write(text)
+	switch newline {
+	case true:
+		r.out.WriteByte('\n')
+	default:
+		r.pending = true
+	}
+}
+
+// flush writes the text queued by the a command
+func (r *scriptReader) flush() {
+	for _, text := range r.appended {
+		r.emit(text, true)
+	}
+	r.appended = r.appended[:0]
+}
+
+// NewScript adds a sed script, which runs on the output of the mappings before it like any other mapping.
+// Scripts cannot be applied simultaneously, in parallel or in place.
+func (t *Transformer) NewScript(script *Script) error {
+	switch script {
+	case nil:
+		return fmt.Errorf("cannot add a nil script")
+	}
+	var flags []byte
+	switch script.Quiet {
+	case true:
+		flags = append(flags, 'n')
+	}
+	switch script.syntax {
+	case syntaxExtended:
+		flags = append(flags, 'E')
+	}
+	t.Mappings.Keys = append(t.Mappings.Keys, []byte(script.source))
+	t.Mappings.Indices = append(t.Mappings.Indices, flags)
+	t.Mappings.Regexps = append(t.Mappings.Regexps, nil)
+	t.Mappings.Options = append(t.Mappings.Options, nil)
+	t.Mappings.Commands = append(t.Mappings.Commands, scriptCommand)
+	return nil
+}
+
+// scriptStage wraps r with a reader running the script at index
+func (t *Transformer) scriptStage(index int, r io.Reader) replacingReader {
+	// The script has been validated when it was added
+	syntax := syntaxBasic
+	switch {
+	case bytes.IndexByte(t.Mappings.Indices[index], 'E') >= 0:
+		syntax = syntaxExtended
+	}
+	script, _ := parseSyntax(string(t.Mappings.Keys[index]), syntax)
+	script.Quiet = bytes.IndexByte(t.Mappings.Indices[index], 'n') >= 0
+	return script.reader(r)
+}
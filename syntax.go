@@ -0,0 +1,293 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// regexSyntax selects how the regular expressions of addresses and scripts are written
+type regexSyntax int
+
+const (
+	// syntaxGo is the syntax of the regexp package, which addresses given on their own use
+	syntaxGo regexSyntax = iota
+	// syntaxBasic is POSIX basic regular expressions with the GNU extensions, which sed scripts use by default
+	syntaxBasic
+	// syntaxExtended is POSIX extended regular expressions with the GNU extensions, like `sed -E`
+	syntaxExtended
+)
+
+// regexScope compiles the regular expressions of an address or a script, in which an empty regular expression
+// stands for the last one before it
+type regexScope struct {
+	syntax   regexSyntax
+	previous *regexp.Regexp
+}
+
+// compile compiles pattern with the flags of the regexp package (like "i" or "m"), or returns the previous
+// regular expression if pattern is empty
+func (sc *regexScope) compile(pattern, flags string) (*regexp.Regexp, error) {
+	switch {
+	case pattern == "" && sc.previous == nil:
+		return nil, fmt.Errorf("no previous regular expression")
+	case pattern == "":
+		return sc.previous, nil
+	}
+	translated := pattern
+	switch sc.syntax {
+	case syntaxBasic, syntaxExtended:
+		var err error
+		translated, err = translateRegex(pattern, sc.syntax == syntaxExtended)
+		switch err {
+		case nil:
+			break
+		default:
+			return nil, fmt.Errorf("invalid regular expression %q: %s", pattern, err.Error())
+		}
+		// A POSIX period matches newlines as well, which the pattern space contains after N or G
+		flags += "s"
+	}
+	switch flags {
+	case "":
+		break
+	default:
+		translated = "(?" + flags + ")" + translated
+	}
+	re, err := regexp.Compile(translated)
+	switch {
+	case err == nil && sc.syntax != syntaxGo:
+		// POSIX matches are the leftmost longest ones, where the regexp package prefers the first alternative
+		re.Longest()
+	}
+	switch err {
+	case nil:
+		sc.previous = re
+		return re, nil
+	default:
+		return nil, err
+	}
+}
+
+// unescapeDelimiter reports how an escaped delimiter is written in the pattern split off by splitDelimited. In sed
+// syntax it stands for the delimiter itself, with whatever meaning that character has in the pattern, while the
+// regexp package gets it quoted.
+func (sc *regexScope) unescapeDelimiter(delim byte) string {
+	switch sc.syntax {
+	case syntaxGo:
+		return regexp.QuoteMeta(string(delim))
+	}
+	return string(delim)
+}
+
+// translateRegex rewrites a POSIX basic (or extended, if extended is set) regular expression, in the dialect of
+// GNU sed, into the syntax of the regexp package. The GNU extensions `\+`, `\?` and `\|` (in basic expressions),
+// `\w`, `\W`, `\s`, `\S`, `\b`, `\B`, `\<`, `\>`, the buffer anchors, `\n`, `\t` and the character escapes
+// `\dNNN`, `\oNNN`, `\xHH` and `\cX` are supported. `\<` and `\>` both match any word boundary. Back-references in
+// the pattern are not supported, as the regexp package guarantees linear time matching.
+func translateRegex(pattern string, extended bool) (string, error) {
+	var out strings.Builder
+	// start is set where a `*` is literal and a `^` is an anchor: at the start of the expression, of a group and of
+	// an alternative
+	start := true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\':
+			switch {
+			case i+1 == len(pattern):
+				return "", fmt.Errorf("trailing backslash")
+			}
+			i++
+			var err error
+			var token string
+			token, i, start, err = translateEscape(pattern, i, start, extended)
+			switch err {
+			case nil:
+				out.WriteString(token)
+			default:
+				return "", err
+			}
+			continue
+		case c == '[':
+			bracket, end, err := translateBracket(pattern, i)
+			switch err {
+			case nil:
+				out.WriteString(bracket)
+				i = end
+			default:
+				return "", err
+			}
+		case c == '*' && start:
+			out.WriteString(`\*`)
+		case c == '^' && (start || extended):
+			out.WriteByte('^')
+			continue
+		case c == '^':
+			out.WriteString(`\^`)
+		case c == '$' && !extended:
+			// A dollar sign is an anchor at the end of the expression, of a group and of an alternative
+			rest := pattern[i+1:]
+			switch {
+			case rest == "" || strings.HasPrefix(rest, `\)`) || strings.HasPrefix(rest, `\|`):
+				out.WriteByte('$')
+			default:
+				out.WriteString(`\$`)
+			}
+		case extended && (c == '(' || c == '|'):
+			out.WriteByte(c)
+			start = true
+			continue
+		case extended && (c == '+' || c == '?') && start:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+		case !extended && strings.IndexByte("+?(){}|", c) >= 0:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			out.WriteByte(c)
+		}
+		start = false
+	}
+	return out.String(), nil
+}
+
+// translateEscape translates the escape sequence whose character is at pattern[i], and returns the index of its last
+// byte and whether a `*` after it is literal
+func translateEscape(pattern string, i int, start, extended bool) (string, int, bool, error) {
+	c := pattern[i]
+	switch {
+	case !extended && c == '(':
+		return "(", i, true, nil
+	case !extended && c == ')':
+		return ")", i, false, nil
+	case !extended && c == '|':
+		return "|", i, true, nil
+	case !extended && c == '{':
+		end := strings.Index(pattern[i:], `\}`)
+		switch {
+		case end < 0:
+			return "", i, false, fmt.Errorf("unmatched \\{")
+		}
+		interval := pattern[i+1 : i+end]
+		switch {
+		case start || interval == "" || strings.Trim(interval, "0123456789,") != "":
+			return "", i, false, fmt.Errorf("invalid interval \\{%s\\}", interval)
+		}
+		return "{" + interval + "}", i + end + 1, false, nil
+	case !extended && (c == '+' || c == '?') && !start:
+		return string(c), i, false, nil
+	case c >= '1' && c <= '9':
+		return "", i, false, fmt.Errorf("back-references like \\%c are not supported", c)
+	case c == '<' || c == '>':
+		return `\b`, i, start, nil
+	case c == '`':
+		return `\A`, i, start, nil
+	case c == '\'':
+		return `\z`, i, start, nil
+	case strings.IndexByte("bBwWsS", c) >= 0:
+		return `\` + string(c), i, false, nil
+	case strings.IndexByte("ntfvra", c) >= 0:
+		return `\` + string(c), i, false, nil
+	case c == 'd' || c == 'o' || c == 'x':
+		// A character given by its decimal, octal or hexadecimal code
+		base, digits := 10, 3
+		switch c {
+		case 'o':
+			base = 8
+		case 'x':
+			base, digits = 16, 2
+		}
+		end := i + 1
+		for end < len(pattern) && end-i-1 < digits && isDigit(pattern[end], base) {
+			end++
+		}
+		code, err := strconv.ParseUint(pattern[i+1:end], base, 8)
+		switch err {
+		case nil:
+			return regexp.QuoteMeta(string(rune(code))), end - 1, false, nil
+		default:
+			return "", i, false, fmt.Errorf("invalid character code \\%s", pattern[i:end])
+		}
+	case c == 'c' && i+1 < len(pattern):
+		return regexp.QuoteMeta(string(rune(strings.ToUpper(pattern[i+1 : i+2])[0] ^ 0x40))), i + 1, false, nil
+	}
+	// Any other escaped character stands for itself
+	r, size := utf8.DecodeRuneInString(pattern[i:])
+	return regexp.QuoteMeta(string(r)), i + size - 1, false, nil
+}
+
+// isDigit reports whether c is a digit in base 8, 10 or 16
+func isDigit(c byte, base int) bool {
+	switch {
+	case c >= '0' && c <= '7':
+		return true
+	case c == '8' || c == '9':
+		return base >= 10
+	case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		return base == 16
+	}
+	return false
+}
+
+// translateBracket translates the bracket expression starting at pattern[i], and returns the index of its closing `]`.
+// Backslashes are literal in POSIX bracket expressions, except for `\n`, `\t` and `\\` which GNU sed expands.
+func translateBracket(pattern string, i int) (string, int, error) {
+	var out strings.Builder
+	out.WriteByte('[')
+	i++
+	switch {
+	case i < len(pattern) && pattern[i] == '^':
+		out.WriteByte('^')
+		i++
+	}
+	// A closing bracket right at the start is literal
+	switch {
+	case i < len(pattern) && pattern[i] == ']':
+		out.WriteString(`\]`)
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == ']':
+			out.WriteByte(']')
+			return out.String(), i, nil
+		case c == '[' && i+1 < len(pattern) && pattern[i+1] == ':':
+			end := strings.Index(pattern[i+2:], ":]")
+			switch {
+			case end < 0:
+				return "", i, fmt.Errorf("unterminated character class")
+			}
+			out.WriteString(pattern[i : i+2+end+2])
+			i += 2 + end + 1
+		case c == '[' && i+1 < len(pattern) && (pattern[i+1] == '=' || pattern[i+1] == '.'):
+			// Equivalence classes and collating symbols of a single character stand for that character
+			end := strings.Index(pattern[i+2:], string(pattern[i+1])+"]")
+			switch {
+			case end < 0:
+				return "", i, fmt.Errorf("unterminated [%c", pattern[i+1])
+			case utf8.RuneCountInString(pattern[i+2:i+2+end]) != 1:
+				return "", i, fmt.Errorf("unsupported [%c%s%c]", pattern[i+1], pattern[i+2:i+2+end], pattern[i+1])
+			}
+			out.WriteString(regexp.QuoteMeta(pattern[i+2 : i+2+end]))
+			i += 2 + end + 1
+		case c == '\\' && i+1 < len(pattern) && pattern[i+1] == 'n':
+			out.WriteString(`\n`)
+			i++
+		case c == '\\' && i+1 < len(pattern) && pattern[i+1] == 't':
+			out.WriteString(`\t`)
+			i++
+		case c == '\\' && i+1 < len(pattern) && pattern[i+1] == '\\':
+			out.WriteString(`\\`)
+			i++
+		case c == '\\' || c == '[':
+			out.WriteString(`\` + string(c))
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return "", i, fmt.Errorf("unterminated [")
+}
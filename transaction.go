@@ -0,0 +1,494 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Transaction replaces several files all or nothing. Stage runs a Replacer up to the point where its temporary
+// file would be renamed over the original, and Commit renames all of the staged files together. Every staged file
+// is recorded in a journal on disk before the transaction takes it over, and so is the end of the commit, so that a
+// transaction interrupted by a crash can be rolled back (or forward, once committed) with OpenJournal. With
+// KeepJournal set, a successful commit can be undone later on the same way.
+type Transaction struct {
+	// JournalPath is the file the journal is written to from the first Stage on
+	JournalPath string
+	// KeepJournal keeps the journal and the originals after a successful commit, until the journal is rolled
+	// back (which undoes the commit) or rolled forward (which discards the originals). The backups configured by
+	// Config.Backup are only made once it is rolled forward.
+	KeepJournal bool
+	mu          sync.Mutex
+	staged      []*stagedFile
+	journal     *Journal
+	finished    bool
+}
+
+// stagedFile is the rewritten content of a file, waiting to be committed
+type stagedFile struct {
+	entry  *JournalEntry
+	report *ReplaceReport
+	// lock is kept from the staging Replacer until the transaction is finished, and checked before committing if detect is set
+	lock   *fileLock
+	detect bool
+}
+
+// Journal is the on-disk record of a Transaction. It is written as one JSON object per line: an entry for every
+// staged file, followed by a last line once the commit is complete.
+type Journal struct {
+	// Committed is set once every file has been replaced. A journal that is not committed was left behind while
+	// staging or committing, and should be rolled back.
+	Committed bool
+	Files     []*JournalEntry
+	path      string
+}
+
+// JournalEntry records a single file of a Journal, by absolute paths
+type JournalEntry struct {
+	// Path is the file that is replaced
+	Path string `json:"path"`
+	// Temp holds the new content until it is renamed over Path
+	Temp string `json:"temp"`
+	// Undo holds the original content once the commit started
+	Undo string `json:"undo"`
+	// Backup is the Config.Backup of the file, which is made from Undo when the journal is rolled forward
+	Backup *Backup `json:"backup,omitempty"`
+}
+
+// journalRecord is a single line of a journal
+type journalRecord struct {
+	File      *JournalEntry `json:"file,omitempty"`
+	Committed bool          `json:"committed,omitempty"`
+}
+
+// NewTransaction returns a new *Transaction type that writes its journal to journalPath
+func NewTransaction(journalPath string) *Transaction {
+	return &Transaction{
+		JournalPath: journalPath,
+		staged:      make([]*stagedFile, 0),
+	}
+}
+
+// Stage applies the mappings of rp like ReplaceChained does (or ReplaceSimultaneous if Transformer.Simultaneous
+// is set), but leaves the original untouched until Commit. Config.InPlace is ignored, and dry runs stage nothing.
+// The first Stage creates the journal, and fails if there already is one at JournalPath.
+func (tx *Transaction) Stage(rp *Replacer) (*ReplaceReport, error) {
+	return tx.StageContext(context.Background(), rp)
+}
+
+// StageContext is like Stage, but gives up as soon as ctx is done.
+func (tx *Transaction) StageContext(ctx context.Context, rp *Replacer) (*ReplaceReport, error) {
+	rp.Config.transaction = tx
+	defer func(rp *Replacer) {
+		rp.Config.transaction = nil
+	}(rp)
+	return rp.replace(ctx)
+}
+
+// stage records the complete temporary file of rp in the journal and takes it over
+func (tx *Transaction) stage(rp *Replacer, tmp *os.File, report *ReplaceReport) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch {
+	case tx.finished:
+		discardTemp(tmp)
+		return fmt.Errorf("the transaction has already been committed or rolled back")
+	}
+	entry, err := newJournalEntry(rp.Config.FilePath, tmp.Name(), rp.Config.Backup)
+	switch err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	for _, staged := range tx.staged {
+		switch {
+		case staged.entry.Path == entry.Path:
+			discardTemp(tmp)
+			return fmt.Errorf("%s has already been staged", rp.Config.FilePath)
+		}
+	}
+	switch tx.journal {
+	case nil:
+		tx.journal = &Journal{Files: make([]*JournalEntry, 0), path: tx.JournalPath}
+	}
+	switch err := tx.journal.append(journalRecord{File: entry}); err {
+	case nil:
+		break
+	default:
+		discardTemp(tmp)
+		return err
+	}
+	tx.journal.Files = append(tx.journal.Files, entry)
+	switch err := flushTemp(tmp); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	tx.staged = append(tx.staged, &stagedFile{
+		entry:  entry,
+		report: report,
+		lock:   rp.Config.lock,
+		detect: rp.Config.DetectChanges,
+	})
+	rp.Config.lock = nil
+	return nil
+}
+
+// newJournalEntry returns the entry of the file at path staged in temp, with absolute paths and a backup that is
+// checked to be possible
+func newJournalEntry(path, temp string, backup *Backup) (*JournalEntry, error) {
+	var err error
+	entry := &JournalEntry{}
+	switch entry.Path, err = filepath.Abs(path); err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	switch entry.Temp, err = filepath.Abs(temp); err {
+	case nil:
+		entry.Undo = entry.Temp + ".undo"
+	default:
+		return nil, err
+	}
+	switch backup {
+	case nil:
+		return entry, nil
+	}
+	abs := *backup
+	switch abs.Dir {
+	case "":
+		break
+	default:
+		switch abs.Dir, err = filepath.Abs(abs.Dir); err {
+		case nil:
+			break
+		default:
+			return nil, err
+		}
+	}
+	switch err := abs.valid(entry.Path); err {
+	case nil:
+		entry.Backup = &abs
+		return entry, nil
+	default:
+		return nil, err
+	}
+}
+
+// Commit replaces every staged file. If any of them cannot be replaced, or was modified since it was staged,
+// the journal is rolled back, so the files replaced so far are restored and nothing is left behind. If the process
+// dies while committing, the journal at JournalPath remains and OpenJournal can roll the commit back.
+func (tx *Transaction) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch {
+	case tx.finished:
+		return fmt.Errorf("the transaction has already been committed or rolled back")
+	case tx.journal == nil:
+		tx.finished = true
+		return nil
+	}
+	tx.finished = true
+	defer tx.release()
+	for _, staged := range tx.staged {
+		switch {
+		case staged.lock != nil && staged.detect:
+			switch err := staged.lock.modified(staged.entry.Path); err {
+			case nil:
+				break
+			default:
+				return tx.abort(err)
+			}
+		}
+	}
+	// Keep the originals, which the journal already points at
+	for _, entry := range tx.journal.Files {
+		switch err := entry.keepOriginal(); err {
+		case nil:
+			break
+		default:
+			return tx.abort(err)
+		}
+	}
+	for _, entry := range tx.journal.Files {
+		switch err := os.Rename(entry.Temp, entry.Path); err {
+		case nil:
+			break
+		default:
+			return tx.abort(err)
+		}
+	}
+	// From here on the files are replaced, a failure leaves the journal behind for OpenJournal to finish
+	switch err := tx.journal.syncDirs(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := tx.journal.append(journalRecord{Committed: true}); err {
+	case nil:
+		tx.journal.Committed = true
+	default:
+		return err
+	}
+	switch tx.KeepJournal {
+	case true:
+		return nil
+	}
+	switch err := tx.journal.RollForward(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	for _, staged := range tx.staged {
+		switch staged.entry.Backup {
+		case nil:
+			continue
+		}
+		staged.report.BackupPath = staged.entry.Backup.path(staged.entry.Path)
+	}
+	return nil
+}
+
+// abort rolls back the journal after the commit failed with err
+func (tx *Transaction) abort(err error) error {
+	switch rollbackErr := tx.journal.RollBack(); rollbackErr {
+	case nil:
+		return err
+	default:
+		return fmt.Errorf("%s, and rolling back failed: %s", err.Error(), rollbackErr.Error())
+	}
+}
+
+// Rollback discards every staged file and removes the journal, leaving the originals untouched
+func (tx *Transaction) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch {
+	case tx.finished:
+		return fmt.Errorf("the transaction has already been committed or rolled back")
+	}
+	tx.finished = true
+	defer tx.release()
+	switch tx.journal {
+	case nil:
+		return nil
+	}
+	return tx.journal.RollBack()
+}
+
+// release releases the locks of the staged files
+func (tx *Transaction) release() {
+	for _, staged := range tx.staged {
+		switch staged.lock {
+		case nil:
+			continue
+		}
+		staged.lock.release()
+	}
+}
+
+// keepOriginal keeps the original content of Path as Undo, unless it already is. A link costs nothing since the
+// new content is renamed over the original.
+func (e *JournalEntry) keepOriginal() error {
+	switch _, err := os.Lstat(e.Undo); {
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+	switch err := os.Link(e.Path, e.Undo); err {
+	case nil:
+		return syncDir(filepath.Dir(e.Undo))
+	}
+	return copyBackup(e.Path, e.Undo)
+}
+
+// backup makes the Backup of the file from Undo, unless there is no Backup or it has been made already
+func (e *JournalEntry) backup() error {
+	switch e.Backup {
+	case nil:
+		return nil
+	}
+	undo, err := os.Stat(e.Undo)
+	switch {
+	case os.IsNotExist(err):
+		// The original was discarded after it was backed up
+		return nil
+	case err != nil:
+		return err
+	}
+	switch newest, err := os.Stat(e.Backup.path(e.Path)); {
+	case err == nil && os.SameFile(newest, undo):
+		return nil
+	}
+	_, err = e.Backup.make(e.Path, e.Undo, true)
+	return err
+}
+
+// OpenJournal reads the journal of a Transaction
+func OpenJournal(path string) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	journal := &Journal{Files: make([]*JournalEntry, 0), path: path}
+	lines := bytes.Split(data, []byte("\n"))
+	for index, line := range lines {
+		var record journalRecord
+		switch err := json.Unmarshal(line, &record); {
+		case len(line) == 0:
+			continue
+		case err != nil && index == len(lines)-1:
+			// The last line was cut short by a crash while it was appended, which left its temporary file behind
+			// without it being taken over
+			break
+		case err != nil:
+			return nil, fmt.Errorf("invalid journal %s: %s", path, err.Error())
+		case record.File != nil:
+			journal.Files = append(journal.Files, record.File)
+		case record.Committed:
+			journal.Committed = true
+		}
+	}
+	return journal, nil
+}
+
+// RollBack restores the original of every file and removes the journal. It undoes a commit that was
+// interrupted as well as one that succeeded. Rolling back can be retried until it succeeds.
+func (j *Journal) RollBack() error {
+	for _, entry := range j.Files {
+		switch err := os.Rename(entry.Undo, entry.Path); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+		// Renaming a link over another link to the same file leaves both in place
+		switch err := os.Remove(entry.Undo); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+		switch err := os.Remove(entry.Temp); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+	}
+	return j.finish()
+}
+
+// RollForward replaces every file that has not been replaced yet, makes the backups of the originals, discards
+// them and removes the journal. Rolling forward can be retried until it succeeds.
+func (j *Journal) RollForward() error {
+	for _, entry := range j.Files {
+		switch _, err := os.Lstat(entry.Temp); {
+		case err == nil && entry.Backup != nil:
+			switch err := entry.keepOriginal(); err {
+			case nil:
+				break
+			default:
+				return err
+			}
+		}
+		switch err := os.Rename(entry.Temp, entry.Path); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+		switch err := entry.backup(); err {
+		case nil:
+			break
+		default:
+			return err
+		}
+		switch err := os.Remove(entry.Undo); {
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+	}
+	return j.finish()
+}
+
+// finish makes the renames durable and removes the journal
+func (j *Journal) finish() error {
+	switch err := j.syncDirs(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := os.Remove(j.path); {
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	return syncDir(filepath.Dir(j.path))
+}
+
+// append adds record to the journal on disk, creating it for the first record
+func (j *Journal) append(record journalRecord) error {
+	data, err := json.Marshal(record)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	flags := os.O_WRONLY | os.O_APPEND
+	switch len(j.Files) {
+	case 0:
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+	fi, err := os.OpenFile(j.path, flags, 0644)
+	switch {
+	case os.IsExist(err):
+		return fmt.Errorf("a journal already exists at %s, roll it back or forward with OpenJournal first", j.path)
+	case err != nil:
+		return err
+	}
+	_, err = fi.Write(append(data, '\n'))
+	switch err {
+	case nil:
+		err = fi.Sync()
+	}
+	switch closeErr := fi.Close(); {
+	case err == nil:
+		err = closeErr
+	}
+	switch {
+	case err == nil && flags&os.O_CREATE != 0:
+		return syncDir(filepath.Dir(j.path))
+	}
+	return err
+}
+
+// syncDirs fsyncs the directory of every file, so that their renames are durable
+func (j *Journal) syncDirs() error {
+	synced := make(map[string]bool)
+	for _, entry := range j.Files {
+		dir := filepath.Dir(entry.Path)
+		switch synced[dir] {
+		case true:
+			continue
+		}
+		switch err := syncDir(dir); err {
+		case nil:
+			synced[dir] = true
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Transformer applies mappings to arbitrary streams, independent of any file.
+// By default the mappings are applied one after another like ReplaceChained does, with Simultaneous set
+// they are all matched in a single pass like ReplaceSimultaneous does.
+type Transformer struct {
+	Mappings     *replacerMappings
+	MaxMatchLen  int
+	Simultaneous bool
+}
+
+// replacingReader is a reader replacing a single mapping
+type replacingReader interface {
+	io.Reader
+	matchCounter
+}
+
+// NewTransformer returns a new *Transformer type without any mappings
+func NewTransformer() *Transformer {
+	return &Transformer{
+		Mappings: &replacerMappings{
+			Keys:     make([][]byte, 0),
+			Indices:  make([][]byte, 0),
+			Regexps:  make([]*regexp.Regexp, 0),
+			Options:  make([]*MappingOptions, 0),
+			Commands: make([]LineCommand, 0),
+		},
+		MaxMatchLen: defaultRegexMaxMatch,
+	}
+}
+
+// NewMapping maps a new oldString:newString []byte entry
+func (t *Transformer) NewMapping(oldString, newString []byte) error {
+	switch len(oldString) {
+	case 0:
+		return fmt.Errorf("cannot replace empty string with new value")
+	}
+	t.Mappings.Keys = append(t.Mappings.Keys, oldString)
+	t.Mappings.Indices = append(t.Mappings.Indices, newString)
+	t.Mappings.Regexps = append(t.Mappings.Regexps, nil)
+	t.Mappings.Options = append(t.Mappings.Options, nil)
+	t.Mappings.Commands = append(t.Mappings.Commands, 0)
+	return nil
+}
+
+// NewStringMapping maps a new oldString:newString string entry
+func (t *Transformer) NewStringMapping(oldString, newString string) error {
+	switch oldString {
+	case "":
+		return fmt.Errorf("cannot replace empty string with new value")
+	}
+	return t.NewMapping([]byte(oldString), []byte(newString))
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that is matched according to options.
+// Such mappings cannot be replaced simultaneously, in parallel or in place.
+func (t *Transformer) NewMappingWithOptions(oldString, newString []byte, options MappingOptions) error {
+	switch err := options.valid(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := t.NewMapping(oldString, newString); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	t.Mappings.Options[len(t.Mappings.Options)-1] = &options
+	return nil
+}
+
+// NewRegexMapping maps a new pattern:template regular expression entry.
+// The template may reference submatches with `$1` or `${name}`, and a single match can be at most
+// `MaxMatchLen` bytes long so the input never has to be buffered as a whole.
+func (t *Transformer) NewRegexMapping(pattern, template string) error {
+	switch pattern {
+	case "":
+		return fmt.Errorf("cannot replace empty pattern with new value")
+	}
+	re, err := regexp.Compile(pattern)
+	switch err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	t.Mappings.Keys = append(t.Mappings.Keys, []byte(pattern))
+	t.Mappings.Indices = append(t.Mappings.Indices, []byte(template))
+	t.Mappings.Regexps = append(t.Mappings.Regexps, re)
+	t.Mappings.Options = append(t.Mappings.Options, nil)
+	t.Mappings.Commands = append(t.Mappings.Commands, 0)
+	return nil
+}
+
+// NewRegexMappingWithOptions maps a new pattern:template regular expression entry that is scoped to options.Lines.
+// Lines is the only option supported by regular expression mappings, use flags like `(?i)` for everything else.
+func (t *Transformer) NewRegexMappingWithOptions(pattern, template string, options MappingOptions) error {
+	switch {
+	case options != MappingOptions{Lines: options.Lines}:
+		return fmt.Errorf("regular expression mappings only support the Lines option")
+	}
+	switch err := options.valid(); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	switch err := t.NewRegexMapping(pattern, template); err {
+	case nil:
+		break
+	default:
+		return err
+	}
+	t.Mappings.Options[len(t.Mappings.Options)-1] = &options
+	return nil
+}
+
+// Reset removes all of the mappings
+func (t *Transformer) Reset() {
+	t.Mappings.Keys = t.Mappings.Keys[:0]
+	t.Mappings.Indices = t.Mappings.Indices[:0]
+	t.Mappings.Regexps = t.Mappings.Regexps[:0]
+	t.Mappings.Options = t.Mappings.Options[:0]
+	t.Mappings.Commands = t.Mappings.Commands[:0]
+}
+
+// clone returns a copy of the transformer with its own mappings, so that resetting one leaves the other intact
+func (t *Transformer) clone() *Transformer {
+	return &Transformer{
+		Mappings: &replacerMappings{
+			Keys:     append(make([][]byte, 0, len(t.Mappings.Keys)), t.Mappings.Keys...),
+			Indices:  append(make([][]byte, 0, len(t.Mappings.Indices)), t.Mappings.Indices...),
+			Regexps:  append(make([]*regexp.Regexp, 0, len(t.Mappings.Regexps)), t.Mappings.Regexps...),
+			Options:  append(make([]*MappingOptions, 0, len(t.Mappings.Options)), t.Mappings.Options...),
+			Commands: append(make([]LineCommand, 0, len(t.Mappings.Commands)), t.Mappings.Commands...),
+		},
+		MaxMatchLen:  t.MaxMatchLen,
+		Simultaneous: t.Simultaneous,
+	}
+}
+
+// Reader returns a reader that applies the mappings to everything read from r.
+// If the mappings cannot be applied, which is the case for regular expressions in simultaneous mode,
+// the returned reader fails with the reason on the first read.
+func (t *Transformer) Reader(r io.Reader) io.Reader {
+	replacer, err := t.pipeline(r)
+	switch err {
+	case nil:
+		return replacer
+	default:
+		return &errReader{err: err}
+	}
+}
+
+// Writer returns a writer that applies the mappings to everything written to it before passing it on to w.
+// The output is streamed to w as it is written, except for the tail that could still be the start of a match
+// straddling two writes, which is only flushed by Close. Close has to be called, and it can be called again.
+func (t *Transformer) Writer(w io.Writer) io.WriteCloser {
+	pr, pw := io.Pipe()
+	tw := &transformWriter{pw: pw, done: make(chan error, 1)}
+	go func(reader io.Reader) {
+		_, err := io.Copy(w, reader)
+		_ = pr.CloseWithError(err)
+		tw.done <- err
+	}(t.Reader(pr))
+	return tw
+}
+
+// Bytes returns a copy of b with the mappings applied, or nil if the mappings cannot be applied.
+func (t *Transformer) Bytes(b []byte) []byte {
+	out, err := ioutil.ReadAll(t.Reader(bytes.NewReader(b)))
+	switch err {
+	case nil:
+		return out
+	default:
+		return nil
+	}
+}
+
+// Copy applies the mappings to everything read from src and writes the result to dst, like io.Copy does.
+// The report has no TempPath.
+func (t *Transformer) Copy(dst io.Writer, src io.Reader) (*ReplaceReport, error) {
+	start := time.Now()
+	counter := &countingReader{r: src}
+	replacer, err := t.pipeline(counter)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	written, err := io.Copy(dst, replacer)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	return &ReplaceReport{
+		Matches:      replacer.matches(),
+		BytesRead:    counter.read,
+		BytesWritten: written,
+		Duration:     time.Since(start),
+	}, nil
+}
+
+// pipeline wraps r according to the mode of the transformer
+func (t *Transformer) pipeline(r io.Reader) (*pipeline, error) {
+	switch t.Simultaneous {
+	case true:
+		return t.simultaneous(r)
+	default:
+		return t.chain(r)
+	}
+}
+
+// stage wraps r with the reader for the mapping at index. A non-nil reuse is reset instead of allocating a new literal reader.
+func (t *Transformer) stage(index int, r io.Reader, reuse *BytesReplacingReader) replacingReader {
+	switch re := t.Mappings.Regexps[index]; {
+	case t.Mappings.Commands[index] == scriptCommand:
+		return t.scriptStage(index, r)
+	case t.Mappings.Commands[index] != 0:
+		return t.lineCommandStage(index, r)
+	case t.Mappings.Options[index] != nil && t.Mappings.Options[index].Lines != "":
+		return t.lineStage(index, r)
+	case re != nil:
+		return NewRegexReplacingReader(r, re, t.Mappings.Indices[index], t.MaxMatchLen)
+	case t.Mappings.Options[index] != nil:
+		return NewMappingReplacingReader(r, t.Mappings.Keys[index], t.Mappings.Indices[index], *t.Mappings.Options[index])
+	case isMapped(r):
+		return newMappedBytesReplacingReader(r.(*mappedReader), t.Mappings.Keys[index], t.Mappings.Indices[index])
+	case reuse != nil:
+		return reuse.Reset(r, t.Mappings.Keys[index], t.Mappings.Indices[index])
+	default:
+		return NewBytesReplacingReader(r, t.Mappings.Keys[index], t.Mappings.Indices[index])
+	}
+}
+
+// lineStage wraps r with a reader applying the mapping at index to the lines selected by its Lines option
+func (t *Transformer) lineStage(index int, r io.Reader) replacingReader {
+	options := *t.Mappings.Options[index]
+	// The address has been validated when the mapping was added
+	address, _ := ParseAddress(options.Lines)
+	// The lines are fed to the replacer directly, so it never reads from its own reader
+	exhausted := &errReader{err: io.EOF}
+	switch re := t.Mappings.Regexps[index]; {
+	case re != nil:
+		return newLineReplacingReader(r, address, replacingEditor{NewRegexReplacingReader(exhausted, re, t.Mappings.Indices[index], t.MaxMatchLen)})
+	}
+	options.Lines = ""
+	return newLineReplacingReader(r, address, replacingEditor{NewMappingReplacingReader(exhausted, t.Mappings.Keys[index], t.Mappings.Indices[index], options)})
+}
+
+// chain wraps r with a reader for every mapping, in order
+func (t *Transformer) chain(r io.Reader) (*pipeline, error) {
+	counters := make([]matchCounter, len(t.Mappings.Keys))
+	for index := range t.Mappings.Keys {
+		replacer := t.stage(index, r, nil)
+		counters[index], r = replacer, replacer
+	}
+	return &pipeline{
+		Reader: r,
+		matches: func() []int {
+			matches := make([]int, len(counters))
+			for index, counter := range counters {
+				matches[index] = counter.Matches()
+			}
+			return matches
+		},
+	}, nil
+}
+
+// simultaneous wraps r with a single reader matching all of the mappings at once
+func (t *Transformer) simultaneous(r io.Reader) (*pipeline, error) {
+	switch err := t.literal("simultaneously"); err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	switch mapped := r.(type) {
+	case *mappedReader:
+		replacer := newMappedMultiReplacingReader(mapped, t.Mappings.Keys, t.Mappings.Indices)
+		return &pipeline{Reader: replacer, matches: func() []int { return replacer.matches }}, nil
+	}
+	replacer := NewMultiBytesReplacingReader(r, t.Mappings.Keys, t.Mappings.Indices)
+	return &pipeline{Reader: replacer, matches: replacer.Matches}, nil
+}
+
+// literal returns an error naming the mode if any of the mappings is a regular expression, has options, is a line command or a script
+func (t *Transformer) literal(mode string) error {
+	for index, re := range t.Mappings.Regexps {
+		switch {
+		case t.Mappings.Commands[index] == scriptCommand:
+			return fmt.Errorf("scripts cannot be applied %s", mode)
+		case t.Mappings.Commands[index] != 0:
+			return fmt.Errorf("line commands cannot be applied %s", mode)
+		case re != nil:
+			return fmt.Errorf("regular expression mappings cannot be replaced %s", mode)
+		case t.Mappings.Options[index] != nil:
+			return fmt.Errorf("mappings with options cannot be replaced %s", mode)
+		}
+	}
+	return nil
+}
+
+// inPlace returns an error if the mappings cannot be applied in place, otherwise whether any of them shrinks its match
+func (t *Transformer) inPlace() (bool, error) {
+	switch err := t.literal("in place"); err {
+	case nil:
+		break
+	default:
+		return false, err
+	}
+	var shrinking bool
+	for index, key := range t.Mappings.Keys {
+		switch value := t.Mappings.Indices[index]; {
+		case len(value) > len(key):
+			return false, fmt.Errorf("cannot replace %q in place: its replacement %q is longer", key, value)
+		case len(value) < len(key):
+			shrinking = true
+		}
+	}
+	return shrinking, nil
+}
+
+// transformWriter feeds everything written to it through a Transformer's reader running on its own goroutine
+type transformWriter struct {
+	pw    *io.PipeWriter
+	done  chan error
+	close sync.Once
+	err   error
+}
+
+// Write implements the `io.Writer` interface.
+func (w *transformWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close flushes the remaining output and returns the first error that occurred while writing it.
+// Closing it again returns the same error.
+func (w *transformWriter) Close() error {
+	w.close.Do(func() {
+		_ = w.pw.Close()
+		w.err = <-w.done
+	})
+	return w.err
+}
+
+// errReader is a reader that always fails with err
+type errReader struct {
+	err error
+}
+
+// Read implements the `io.Reader` interface.
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
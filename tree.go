@@ -0,0 +1,366 @@
+// Copyright GoSed (c) 2021, Carter Peel
+// This code is licensed under MIT license (see LICENSE for details)
+
+package gosed
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// binarySniffLen is the number of leading bytes checked for NUL bytes when detecting binary files, like git does
+const binarySniffLen = 8000
+
+// TreeReplacer applies a single set of mappings to every matching file below a root directory
+type TreeReplacer struct {
+	Root string
+	// Include limits the files to those matching at least one of these globs, all files are included when empty
+	Include []string
+	// Exclude skips files and directories matching any of these globs
+	Exclude []string
+	// IgnoreFiles are the names of gitignore-style files that are honoured in every directory
+	IgnoreFiles []string
+	// SkipBinary skips files that contain a NUL byte in their first few kilobytes, after decompressing them if
+	// Compression is set
+	SkipBinary bool
+	// Compression is passed on to the Replacer of every file, CompressionAuto replaces within the compressed files
+	// of the tree as well as the others
+	Compression Compression
+	// PreserveMetadata, DryRun and DiffOutput are passed on to the Replacer of every file
+	PreserveMetadata bool
+	DryRun           bool
+	DiffOutput       io.Writer
+	// Backup keeps the original of every replaced file. A backup Dir mirrors the directories below Root,
+	// and is skipped if it lies within Root.
+	Backup *Backup
+	// Lock and LockTimeout are passed on to the Replacer of every file. While a Journal is used, the locks are held
+	// until all of the files are committed or rolled back.
+	Lock        LockMode
+	LockTimeout time.Duration
+	// Journal makes ReplaceContext replace all of the files or none of them, in a Transaction that writes its
+	// journal to this path
+	Journal string
+	// Concurrency is the number of files replaced at once
+	Concurrency int
+	Transformer *Transformer
+	diffMu      sync.Mutex
+	transaction *Transaction
+}
+
+// FileReport is the outcome of replacing a single file of a tree
+type FileReport struct {
+	Path   string
+	Report *ReplaceReport
+	Err    error
+}
+
+// NewTreeReplacer returns a new *TreeReplacer type for the directory tree at root.
+// It honours .gitignore files, skips .git directories and binary files by default.
+func NewTreeReplacer(root string) *TreeReplacer {
+	return &TreeReplacer{
+		Root:             root,
+		Include:          make([]string, 0),
+		Exclude:          []string{".git/"},
+		IgnoreFiles:      []string{".gitignore"},
+		SkipBinary:       true,
+		PreserveMetadata: true,
+		Concurrency:      1,
+		Transformer:      NewTransformer(),
+	}
+}
+
+// NewMapping maps a new oldString:newString []byte entry
+func (tr *TreeReplacer) NewMapping(oldString, newString []byte) error {
+	return tr.Transformer.NewMapping(oldString, newString)
+}
+
+// NewStringMapping maps a new oldString:newString string entry
+func (tr *TreeReplacer) NewStringMapping(oldString, newString string) error {
+	return tr.Transformer.NewStringMapping(oldString, newString)
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that is matched according to options
+func (tr *TreeReplacer) NewMappingWithOptions(oldString, newString []byte, options MappingOptions) error {
+	return tr.Transformer.NewMappingWithOptions(oldString, newString, options)
+}
+
+// NewRegexMappingWithOptions maps a new pattern:template regular expression entry that is scoped to options.Lines
+func (tr *TreeReplacer) NewRegexMappingWithOptions(pattern, template string, options MappingOptions) error {
+	return tr.Transformer.NewRegexMappingWithOptions(pattern, template, options)
+}
+
+// NewLineCommand adds a command that edits the lines selected by a sed-style address
+func (tr *TreeReplacer) NewLineCommand(address string, command LineCommand, text string) error {
+	return tr.Transformer.NewLineCommand(address, command, text)
+}
+
+// NewLineCommandString adds a line command written like in a sed script, such as `/^\[server\]/a port=80`
+func (tr *TreeReplacer) NewLineCommandString(expr string) error {
+	return tr.Transformer.NewLineCommandString(expr)
+}
+
+// NewScript adds a sed script, which runs on the output of the mappings before it
+func (tr *TreeReplacer) NewScript(script *Script) error {
+	return tr.Transformer.NewScript(script)
+}
+
+// NewRegexMapping maps a new pattern:template regular expression entry
+func (tr *TreeReplacer) NewRegexMapping(pattern, template string) error {
+	return tr.Transformer.NewRegexMapping(pattern, template)
+}
+
+// Replace applies the mappings to every matching file, see ReplaceContext.
+func (tr *TreeReplacer) Replace() ([]*FileReport, error) {
+	return tr.ReplaceContext(context.Background())
+}
+
+// ReplaceContext applies the mappings to every matching file, Concurrency files at a time.
+// A file that fails is recorded in its FileReport and does not stop the others, the returned error
+// is only set when the tree itself could not be walked or ctx is done. With Journal set, the files are
+// only replaced if none of them failed, otherwise the returned error is a ReplaceErrors.
+func (tr *TreeReplacer) ReplaceContext(ctx context.Context) ([]*FileReport, error) {
+	paths, err := tr.Files()
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	switch tr.Journal {
+	case "":
+		tr.transaction = nil
+	default:
+		tr.transaction = NewTransaction(tr.Journal)
+	}
+	indices := make(map[string]int, len(paths))
+	for index, path := range paths {
+		indices[path] = index
+	}
+	pool := NewPool(tr.Concurrency)
+	pool.Configure = tr.configure
+	go func() {
+		for _, path := range paths {
+			switch ctx.Err() {
+			case nil:
+				pool.SubmitFile(ctx, path, tr.Transformer)
+				continue
+			}
+			break
+		}
+		_ = pool.Close()
+	}()
+	// Keep the reports in walk order, no matter in which order they complete
+	reports := make([]*FileReport, len(paths))
+	for report := range pool.Results() {
+		reports[indices[report.Path]] = report
+	}
+	completed := reports[:0]
+	for _, report := range reports {
+		switch report {
+		case nil:
+			continue
+		}
+		completed = append(completed, report)
+	}
+	switch tr.transaction {
+	case nil:
+		return completed, ctx.Err()
+	}
+	return completed, tr.finish(ctx, completed)
+}
+
+// finish commits the transaction of a tree if every file was staged, and rolls it back otherwise
+func (tr *TreeReplacer) finish(ctx context.Context, reports []*FileReport) error {
+	failed := make(ReplaceErrors, 0)
+	for _, report := range reports {
+		switch report.Err {
+		case nil:
+			continue
+		}
+		failed = append(failed, report)
+	}
+	switch {
+	case ctx.Err() != nil:
+		_ = tr.transaction.Rollback()
+		return ctx.Err()
+	case len(failed) > 0:
+		_ = tr.transaction.Rollback()
+		return failed
+	}
+	return tr.transaction.Commit()
+}
+
+// Files returns the paths of all files below Root that the mappings would be applied to
+func (tr *TreeReplacer) Files() ([]string, error) {
+	include, err := compileGlobs(tr.Include)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	exclude, err := compileGlobs(tr.Exclude)
+	switch err {
+	case nil:
+		break
+	default:
+		return nil, err
+	}
+	ignored := make(ignoreList, 0)
+	paths := make([]string, 0)
+	err = filepath.WalkDir(tr.Root, func(path string, d fs.DirEntry, err error) error {
+		switch err {
+		case nil:
+			break
+		default:
+			return err
+		}
+		rel, err := filepath.Rel(tr.Root, path)
+		switch err {
+		case nil:
+			break
+		default:
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case rel == "." && d.IsDir():
+			// The root itself can neither be excluded nor ignored
+		case d.IsDir() && tr.Backup != nil && tr.Backup.Dir != "" && samePath(path, tr.Backup.Dir):
+			return filepath.SkipDir
+		case exclude.matchAny(rel, d.IsDir()) || ignored.ignored(rel, d.IsDir()):
+			switch d.IsDir() {
+			case true:
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			for _, name := range tr.IgnoreFiles {
+				list, err := readIgnoreFile(filepath.Join(path, name), rel)
+				switch err {
+				case nil:
+					break
+				default:
+					return err
+				}
+				ignored = append(ignored, list...)
+			}
+			return nil
+		case !d.Type().IsRegular():
+			// Replacing a symlink or device would turn it into a regular file
+			return nil
+		case len(include) > 0 && !include.matchAny(rel, false):
+			return nil
+		}
+		switch tr.SkipBinary {
+		case true:
+			binary, err := isBinary(path, tr.Compression)
+			switch {
+			case err != nil:
+				return err
+			case binary:
+				return nil
+			}
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	return paths, err
+}
+
+// configure passes the options of the tree on to the Replacer of a single file
+func (tr *TreeReplacer) configure(rp *Replacer) {
+	rp.Config.PreserveMetadata = tr.PreserveMetadata
+	rp.Config.DryRun = tr.DryRun
+	rp.Config.DiffOutput = tr.DiffOutput
+	rp.Config.Compression = tr.Compression
+	rp.Config.Lock = tr.Lock
+	rp.Config.LockTimeout = tr.LockTimeout
+	rp.Config.transaction = tr.transaction
+	switch {
+	case tr.Backup != nil && tr.Backup.Dir != "":
+		backup := *tr.Backup
+		switch rel, err := filepath.Rel(tr.Root, filepath.Dir(rp.Config.FilePath)); err {
+		case nil:
+			backup.Dir = filepath.Join(backup.Dir, rel)
+		}
+		rp.Config.Backup = &backup
+	default:
+		rp.Config.Backup = tr.Backup
+	}
+	switch {
+	case tr.DryRun && tr.Concurrency > 1:
+		// Diffs of files replaced at the same time would interleave, so each one is written out in one go
+		var output io.Writer = os.Stdout
+		switch {
+		case tr.DiffOutput != nil:
+			output = tr.DiffOutput
+		}
+		rp.Config.DiffOutput = &lockedWriter{w: output, mu: &tr.diffMu}
+	}
+}
+
+// isBinary reports whether the file at path has a NUL byte in its first binarySniffLen bytes, which are decompressed
+// first if the file is compressed according to compression
+func isBinary(path string, compression Compression) (bool, error) {
+	compression, err := resolveCompression(path, compression)
+	switch err {
+	case nil:
+		break
+	default:
+		return false, err
+	}
+	var codec Codec
+	switch compression {
+	case CompressionNone:
+		break
+	default:
+		codec, err = lookupCodec(compression)
+		switch err {
+		case nil:
+			break
+		default:
+			// The file cannot be replaced, which is reported once its Replacer gets to it
+			return false, nil
+		}
+	}
+	fi, err := os.Open(path)
+	switch err {
+	case nil:
+		break
+	default:
+		return false, err
+	}
+	defer func(fi *os.File) {
+		_ = fi.Close()
+	}(fi)
+	r, err := decompress(codec, fi)
+	switch err {
+	case nil:
+		break
+	default:
+		// A corrupt compressed file is reported once its Replacer gets to it
+		return false, nil
+	}
+	defer func(r io.Closer) {
+		_ = r.Close()
+	}(r)
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == nil || err == io.EOF || err == io.ErrUnexpectedEOF:
+		return bytes.IndexByte(buf[:n], 0) >= 0, nil
+	case codec != nil:
+		return false, nil
+	default:
+		return false, err
+	}
+}